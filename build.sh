@@ -4,7 +4,7 @@ set -e
 
 DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" && pwd )"
 
-(cd src/privileged && GOOS=linux go build -mod=mod -v -o $DIR/docker/privileged/privileged)
-(cd src/restricted && GOOS=linux go build -mod=mod -v -o $DIR/docker/restricted/restricted)
-(cd src/external && GOOS=linux go build -mod=mod -v -o $DIR/docker/external/external)
+(cd src/client && GOOS=linux go build -mod=mod -v -o $DIR/docker/privileged/client)
+cp $DIR/docker/privileged/client $DIR/docker/restricted/client
+cp $DIR/docker/privileged/client $DIR/docker/external/client
 (cd src/db-server && GOOS=linux go build -mod=mod -v -o $DIR/docker/db/db-server)
@@ -21,11 +21,94 @@ allow {
     not is_day_restricted
 }
 
+# workloads of federated partner trust domains can read the patients without
+# PII during the business hours of New York, except on the holidays of data.json
+partner_domains := {"partner.test"}
+
+partner_tz := "America/New_York"
+
+partner_hours := {
+    "windows": [{"days": ["Monday", "Tuesday", "Wednesday", "Thursday", "Friday"], "start": "09:00", "end": "18:00"}],
+    "holidays": holidays,
+}
+
+holidays = data.holidays {
+    data.holidays
+} else = [] {
+    true
+}
+
+allow {
+    input.federated
+    partner_domains[input.trustDomain]
+    schedule.within(partner_hours, partner_tz)
+}
+
+# the server gives the time of the decision as input.now_ns and the time zone
+# of the days as input.tz, the current time in UTC is used when the policy is
+# evaluated by hand
+now_ns = input.now_ns {
+    input.now_ns
+} else = time.now_ns() {
+    true
+}
+
+tz = input.tz {
+    input.tz
+} else = "UTC" {
+    true
+}
+
 is_day_restricted {
-    day := time.weekday(time.now_ns())
+    day := time.weekday([now_ns, tz])
     restricted_days[day]
 }
 
+# reasons sent to a denied workload, e.g. "external is blocked on Wednesdays"
+known_workloads := {
+    "spiffe://domain.test/privileged",
+    "spiffe://domain.test/restricted",
+    "spiffe://domain.test/external",
+}
+
+deny_reasons[msg] {
+    not input.federated
+    not known_workloads[input.peerID]
+    msg := sprintf("%v is not a known workload", [input.peerID])
+}
+
+deny_reasons[msg] {
+    input.federated
+    not partner_domains[input.trustDomain]
+    msg := sprintf("trust domain %v is not a partner", [input.trustDomain])
+}
+
+deny_reasons[msg] {
+    input.federated
+    partner_domains[input.trustDomain]
+    not schedule.within(partner_hours, partner_tz)
+    msg := sprintf("partners are only allowed during the business hours of %v", [partner_tz])
+}
+
+deny_reasons[msg] {
+    input.peerID == "spiffe://domain.test/external"
+    is_day_restricted
+    day := time.weekday([now_ns, tz])
+    msg := sprintf("external is blocked on %vs", [day])
+}
+
 pii = ["SSN", "EnrolleeType"] {
     input.peerID == "spiffe://domain.test/restricted"
 }
+
+pii = ["SSN", "EnrolleeType"] {
+    partner_domains[input.trustDomain]
+}
+
+# rate and concurrency limits per workload: commands per second, burst size
+# and maximum number of concurrent connections
+limits := {
+    "spiffe://domain.test/privileged": {"rate": 50, "burst": 100, "max_conns": 20},
+    "spiffe://domain.test/restricted": {"rate": 10, "burst": 20, "max_conns": 10},
+    "spiffe://domain.test/external": {"rate": 1, "burst": 5, "max_conns": 2},
+}
@@ -1,2 +1,2 @@
 #!/bin/sh
-external -log /tmp/external.log
+client -addr :8003 -log /tmp/external.log
@@ -1,2 +1,2 @@
 #!/bin/sh
-privileged -log /tmp/privileged.log
+client -addr :8001 -log /tmp/privileged.log
@@ -1,2 +1,2 @@
 #!/bin/sh
-restricted -log /tmp/restricted.log
+client -addr :8002 -log /tmp/restricted.log
@@ -1,7 +1,59 @@
-package example
+package example.client
 
-default allow = false
+# rules evaluated by the client when it connects to a server
 
-allow {
+default allow_server = false
+
+allow_server {
     input.peerID == "spiffe://domain.test/db-server"
 }
+
+deny_reasons[msg] {
+    not allow_server
+    msg := sprintf("%v is not a trusted db server", [input.peerID])
+}
+
+# rules evaluated for the HTTP callers authenticated with a JWT-SVID
+# (client started with -jwt-audience)
+
+default allow_http = false
+
+allow_http {
+    input.peerID == "spiffe://domain.test/api-server"
+    input.method == "GET"
+}
+
+http_deny_reasons[msg] {
+    not allow_http
+    msg := sprintf("%v may not %v %v", [input.peerID, input.method, input.path])
+}
+
+# rules evaluated for the HTTP callers presenting a SVID (client started with -tls-mode mtls)
+
+default allow_caller = false
+
+allow_caller {
+    input.peerID == "spiffe://domain.test/api-server"
+}
+
+caller_deny_reasons[msg] {
+    not allow_caller
+    msg := sprintf("%v may not call the HTTP API", [input.peerID])
+}
+
+# rules evaluated for each HTTP request (client started with
+# -http-rule data.example.client.allow_request
+# -http-deny-reasons-rule data.example.client.request_deny_reasons)
+
+default allow_request = false
+
+allow_request {
+    input.peerID == "spiffe://domain.test/api-server"
+    input.method == "GET"
+    {"/connect", "/getdata"}[input.path]
+}
+
+request_deny_reasons[msg] {
+    not allow_request
+    msg := sprintf("%v may not %v %v", [input.peerID, input.method, input.path])
+}
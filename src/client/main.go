@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"path"
+	"strings"
+
+	"flag"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"net/http"
+
+	"io"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// This client serves any workload calling the db server, e.g. the
+// privileged, restricted and external ones. Its SPIFFE ID is the one of the
+// X509-SVID issued to it by the Workload API.
+
+var (
+	addrFlag      = flag.String("addr", ":8001", "address to bind the client server to")
+	nameFlag      = flag.String("name", "", "service name in logs and traces (empty=last path segment of the SPIFFE ID)")
+	dbAddrFlag    = flag.String("db-addr", "db:8082", "address of the db server")
+	expectedFlag  = flag.String("expected-spiffe-id", "", "SPIFFE ID the workload must be issued (empty=any)")
+	routesFlag    = flag.String("routes", "/connect=connect,/getdata=getdata", "comma separated path=handler routes, handlers are connect and getdata")
+	logFlag       = flag.String("log", "", "path to log to (empty=stderr)")
+	logLevelFlag  = flag.String("log-level", "info", "minimum level of the logs (debug, info, warn, error)")
+	logFormatFlag = flag.String("log-format", "json", "format of the logs (json, text)")
+	otlpFlag      = flag.String("otlp-endpoint", "", "OTLP/HTTP collector address to export traces to (empty=disabled)")
+	clockFlag     = flag.String("policy-time", "", "RFC 3339 instant the policies are evaluated at, e.g. 2024-01-01T09:00:00Z (empty=now)")
+	clockTZFlag   = flag.String("policy-tz", "", "IANA time zone the policies evaluate days in, e.g. America/New_York (empty=UTC)")
+	socketFlag    = flag.String("spiffe-socket", "", "Workload API address (empty=$SPIFFE_ENDPOINT_SOCKET or "+common.DefaultSocketPath+")")
+	poolIdleFlag  = flag.Int("pool-max-idle", common.DefaultPoolConfig.MaxIdle, "maximum number of idle connections to the db server")
+	poolOpenFlag  = flag.Int("pool-max-open", common.DefaultPoolConfig.MaxOpen, "maximum number of open connections to the db server (0=unlimited)")
+	poolTTLFlag   = flag.Duration("pool-idle-timeout", common.DefaultPoolConfig.IdleTimeout, "close connections to the db server idle for longer")
+	tlsModeFlag   = flag.String("tls-mode", "plain", "how the HTTP API is served: plain (local development) or mtls (callers need a SVID)")
+	httpRuleFlag  = flag.String("http-rule", "", "OPA rule authorizing each HTTP request, e.g. data.example.client.allow_request (empty=disabled)")
+	httpDenyFlag  = flag.String("http-deny-reasons-rule", "", "OPA rule giving the reasons of a denied HTTP request (empty=none)")
+	jwtAudFlag    = flag.String("jwt-audience", "", "comma separated audiences of the JWT-SVIDs required from HTTP callers (empty=no authentication)")
+	jwtBundleFlag = flag.String("jwt-bundle", "", "JWKS file of the JWT bundle validating the JWT-SVIDs (empty=Workload API)")
+	jwtTDFlag     = flag.String("jwt-trust-domain", "", "trust domain of the JWKS file (empty=trust domain of the SVID)")
+	svidCertFlag  = flag.String("svid-cert", "", "PEM file of the X509-SVID, used instead of the Workload API (empty=Workload API)")
+	svidKeyFlag   = flag.String("svid-key", "", "PEM file of the X509-SVID private key, required with -svid-cert")
+	svidBndlFlag  = flag.String("svid-bundle", "", "PEM file of the X509 bundle of the trust domain, required with -svid-cert")
+	fedBundleFlag = flag.String("federated-bundles", "", "comma separated td=path bundles of federated trust domains, SPIFFE bundles (.json) or PEM (empty=none)")
+	fedEndptFlag  = flag.String("federated-endpoints", "", "comma separated td=url or td=url|spiffe-id bundle endpoints of federated trust domains (empty=none)")
+	metricsFlag   = flag.String("metrics-addr", ":9001", "address to serve Prometheus metrics on (empty=disabled)")
+)
+
+// handlers are the handlers of a client that can be routed with the routes flag
+var handlers = map[string]func(*common.DBClient, http.ResponseWriter, *http.Request){
+	"connect": (*common.DBClient).HandleConnect,
+	"getdata": (*common.DBClient).HandleGetData,
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() (err error) {
+	flag.Parse()
+	logOutput := io.Writer(os.Stdout)
+	if *logFlag != "" {
+		logFile, err := os.OpenFile(*logFlag, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to open log file: %v", err)
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+
+	// Share a single Workload API connection, or SVID files, across requests, SVIDs are rotated in the background
+	source, err := common.NewX509SourceFromFlags(context.Background(), *svidCertFlag, *svidKeyFlag, *svidBndlFlag, common.WithSocketPath(*socketFlag))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	client := &common.DBClient{Source: source, ExpectedID: *expectedFlag}
+	svid, err := client.CurrentSVID()
+	if err != nil {
+		return err
+	}
+
+	name := *nameFlag
+	if name == "" {
+		name = path.Base(svid.ID.Path())
+	}
+
+	if err := common.InitLogging(logOutput, *logFormatFlag, *logLevelFlag, name); err != nil {
+		return err
+	}
+
+	slog.Info("starting client server...", "spiffe_id", svid.ID.String(), "svid_expiry", svid.Certificates[0].NotAfter)
+
+	// Policies may be evaluated at a simulated instant and in the time zone of the partners
+	policyClock, err := opa.ClockFromFlags(*clockFlag, *clockTZFlag)
+	if err != nil {
+		return err
+	}
+	opa.SetClock(policyClock)
+
+	shutdownTracing, err := common.InitTracing(context.Background(), name, *otlpFlag)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	// The db server and the HTTP callers may belong to federated trust domains
+	fedCtx, stopFederation := context.WithCancel(context.Background())
+	defer stopFederation()
+	federated, err := common.NewFederatedBundlesFromFlags(fedCtx, *fedBundleFlag, *fedEndptFlag, source)
+	if err != nil {
+		return err
+	}
+	poolOptions := []common.Option{common.WithX509Source(source)}
+	var bundles x509bundle.Source = source
+	if federated != nil {
+		poolOptions = append(poolOptions, common.WithFederatedBundles(federated))
+		bundles = common.WithFederated(source, federated)
+	}
+
+	client.Pool = common.NewPool(*dbAddrFlag, common.PoolConfig{
+		MaxIdle:     *poolIdleFlag,
+		MaxOpen:     *poolOpenFlag,
+		IdleTimeout: *poolTTLFlag,
+	}, poolOptions...)
+	defer client.Pool.Close()
+
+	// Metrics are served apart from the HTTP API, which may require mTLS or a JWT-SVID
+	if *metricsFlag != "" {
+		metricsServer := &http.Server{Addr: *metricsFlag, Handler: promhttp.Handler()}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("unable to serve metrics", "error", err)
+			}
+		}()
+		defer metricsServer.Close()
+	}
+
+	routes, err := parseRoutes(*routesFlag, client)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", *addrFlag)
+	if err != nil {
+		return fmt.Errorf("unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	tlsConfig, err := serverTLSConfig(*tlsModeFlag, source, bundles, svid.ID.TrustDomain().String())
+	if err != nil {
+		return err
+	}
+
+	auth, closeAuth, err := jwtAuth(svid.ID.TrustDomain().String())
+	if err != nil {
+		return err
+	}
+	defer closeAuth()
+
+	r := chi.NewRouter()
+	r.Use(noCache, common.RequestID, common.Tracing)
+	r.Group(func(r chi.Router) {
+		r.Use(auth)
+		if *httpRuleFlag != "" {
+			r.Use(common.OPAAuthz(*httpRuleFlag, *httpDenyFlag, bundles))
+		}
+		for route, handler := range routes {
+			r.Get(route, handler)
+		}
+	})
+
+	slog.Info("listening...", "addr", ln.Addr().String(), "tls_mode", *tlsModeFlag)
+	server := &http.Server{
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+// serverTLSConfig returns the TLS configuration of the HTTP API for mode,
+// nil in plain mode. In mtls mode callers must present a SVID, validated
+// with bundles, authorized by data.example.client.allow_caller.
+func serverTLSConfig(mode string, source x509svid.Source, bundles x509bundle.Source, trustDomain string) (*tls.Config, error) {
+	switch mode {
+	case "plain":
+		return nil, nil
+	case "mtls":
+		return tlsconfig.MTLSServerConfig(source, bundles, common.Authorizer(context.Background(), opa.RoleHTTPServer, trustDomain)), nil
+	default:
+		return nil, fmt.Errorf("invalid TLS mode %q", mode)
+	}
+}
+
+// jwtAuth returns the middleware authenticating the HTTP callers with a
+// JWT-SVID, or a pass-through one if no audience is configured
+func jwtAuth(trustDomain string) (func(http.Handler) http.Handler, func() error, error) {
+	noop := func() error { return nil }
+	if *jwtAudFlag == "" {
+		return func(next http.Handler) http.Handler { return next }, noop, nil
+	}
+	audience := strings.Split(*jwtAudFlag, ",")
+
+	if *jwtBundleFlag != "" {
+		if *jwtTDFlag != "" {
+			trustDomain = *jwtTDFlag
+		}
+		bundle, err := common.LoadJWTBundle(trustDomain, *jwtBundleFlag)
+		if err != nil {
+			return nil, nil, err
+		}
+		return common.JWTAuth(bundle, audience), noop, nil
+	}
+
+	source, err := common.NewJWTSource(context.Background(), common.WithSocketPath(*socketFlag))
+	if err != nil {
+		return nil, nil, err
+	}
+	return common.JWTAuth(source, audience), source.Close, nil
+}
+
+// parseRoutes parses the routes flag, e.g. "/connect=connect,/getdata=getdata",
+// into the handlers of client
+func parseRoutes(s string, client *common.DBClient) (map[string]http.HandlerFunc, error) {
+	routes := map[string]http.HandlerFunc{}
+	for _, route := range strings.Split(s, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+		p, name, ok := strings.Cut(route, "=")
+		if !ok || !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("invalid route %q, expected /path=handler", route)
+		}
+		handler, ok := handlers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown handler %q in route %q", name, route)
+		}
+		if _, ok := routes[p]; ok {
+			return nil, fmt.Errorf("duplicate route %q", p)
+		}
+		routes[p] = func(w http.ResponseWriter, r *http.Request) { handler(client, w, r) }
+	}
+	return routes, nil
+}
+
+func noCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Expires", "0")
+		h.ServeHTTP(w, r)
+	})
+}
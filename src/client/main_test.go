@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  string
+		want    []string
+		wantErr bool
+	}{
+		{"default", "/connect=connect,/getdata=getdata", []string{"/connect", "/getdata"}, false},
+		{"spaces and empty routes", " /connect=connect, ,/data=getdata,", []string{"/connect", "/data"}, false},
+		{"same handler twice", "/a=getdata,/b=getdata", []string{"/a", "/b"}, false},
+		{"empty", "", nil, false},
+		{"missing handler", "/connect", nil, true},
+		{"relative path", "connect=connect", nil, true},
+		{"unknown handler", "/connect=delete", nil, true},
+		{"duplicate route", "/connect=connect,/connect=getdata", nil, true},
+	}
+	for _, tt := range tests {
+		routes, err := parseRoutes(tt.routes, &common.DBClient{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for route := range routes {
+			got = append(got, route)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got routes %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestServerTLSConfigAuthorizesCallers serves the HTTP API in mtls mode with
+// the privileged policy, which only allows the api server to call it
+func TestServerTLSConfigAuthorizesCallers(t *testing.T) {
+	spiffetest.Chdir(t, filepath.Join("..", "..", "docker", "privileged", "opa"))
+	ca := spiffetest.NewCA(t, "domain.test")
+	source := ca.X509Source("spiffe://domain.test/privileged")
+
+	tlsConfig, err := serverTLSConfig("mtls", source, source, "domain.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	tests := []struct {
+		caller  string
+		allowed bool
+	}{
+		{"spiffe://domain.test/api-server", true},
+		{"spiffe://domain.test/external", false},
+	}
+	for _, tt := range tests {
+		caller := ca.X509Source(tt.caller)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: tlsconfig.MTLSClientConfig(caller, caller, tlsconfig.AuthorizeID(source.SVID.ID)),
+		}}
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		if allowed := err == nil && resp.StatusCode == http.StatusOK; allowed != tt.allowed {
+			t.Errorf("%s: got %v, want allowed=%v", tt.caller, err, tt.allowed)
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+func TestServerTLSConfigModes(t *testing.T) {
+	source := spiffetest.NewCA(t, "domain.test").X509Source("spiffe://domain.test/privileged")
+	tests := []struct {
+		mode    string
+		mtls    bool
+		wantErr bool
+	}{
+		{"plain", false, false},
+		{"mtls", true, false},
+		{"tls", false, true},
+	}
+	for _, tt := range tests {
+		config, err := serverTLSConfig(tt.mode, source, source, "domain.test")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+		if mtls := config != nil && config.ClientAuth == tls.RequireAnyClientCert; mtls != tt.mtls {
+			t.Errorf("%s: got config %v, want mtls=%v", tt.mode, config, tt.mtls)
+		}
+	}
+}
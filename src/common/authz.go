@@ -0,0 +1,108 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// hiddenHeaders are the credentials left out of the policy input, which is logged
+var hiddenHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+}
+
+// OPAAuthz is a middleware authorizing each HTTP request with the OPA rule,
+// e.g. data.example.http.allow. The input holds the SPIFFE ID of the peer
+// ("peerID"), taken from its X509-SVID, verified with bundles, when served
+// over mTLS or from the JWT-SVID validated by JWTAuth, along with "method",
+// "path", "headers" and "query". The reasons of a denial are taken from
+// denyReasonsRule, which may be empty. Denied requests get a 403 with a
+// Result explaining why.
+func OPAAuthz(rule, denyReasonsRule string, bundles x509bundle.Source) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			peerID, err := requestPeerID(r, bundles)
+			if err != nil {
+				writeAuthError(ctx, w, http.StatusUnauthorized, err)
+				return
+			}
+
+			ctx = WithLogAttrs(ctx, "caller_id", peerID)
+			if err := opa.Authorize(ctx, rule, denyReasonsRule, requestInput(r, peerID)); err != nil {
+				var denied *opa.DeniedError
+				if errors.As(err, &denied) {
+					writeAuthError(ctx, w, http.StatusForbidden, err)
+				} else {
+					writeAuthError(ctx, w, http.StatusInternalServerError, fmt.Errorf("unable to authorize caller: %v", err))
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestPeerID returns the SPIFFE ID of the caller. The X509-SVID is
+// verified again: the handshake of tlsconfig.MTLSServerConfig does not record
+// the verified chains, and the certificates may not have been verified at all.
+func requestPeerID(r *http.Request, bundles x509bundle.Source) (string, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if bundles == nil {
+			return "", errors.New("unable to verify peer X509-SVID: no bundle")
+		}
+		id, _, err := x509svid.Verify(r.TLS.PeerCertificates, bundles)
+		if err != nil {
+			return "", fmt.Errorf("invalid peer X509-SVID: %v", err)
+		}
+		return id.String(), nil
+	}
+	if svid, ok := JWTSVIDFromContext(r.Context()); ok {
+		return svid.ID.String(), nil
+	}
+	return "", errors.New("no SPIFFE ID: the caller presented neither a X509-SVID nor a JWT-SVID")
+}
+
+// requestInput builds the policy input of a request. Multi-valued headers
+// and query parameters are lists of strings.
+func requestInput(r *http.Request, peerID string) map[string]interface{} {
+	headers := map[string]interface{}{}
+	for name, values := range r.Header {
+		if !hiddenHeaders[name] {
+			headers[strings.ToLower(name)] = stringsToInterfaces(values)
+		}
+	}
+
+	query := map[string]interface{}{}
+	for name, values := range r.URL.Query() {
+		query[name] = stringsToInterfaces(values)
+	}
+
+	input := map[string]interface{}{
+		"peerID":  peerID,
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"headers": headers,
+		"query":   query,
+	}
+	if svid, ok := JWTSVIDFromContext(r.Context()); ok {
+		input["claims"] = svid.Claims
+	}
+	return input
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	r := make([]interface{}, len(values))
+	for i, v := range values {
+		r[i] = v
+	}
+	return r
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+)
+
+// The request rules are those of the privileged client, allowing
+// spiffe://domain.test/api-server to GET /connect and /getdata
+const (
+	requestRule            = "data.example.client.allow_request"
+	requestDenyReasonsRule = "data.example.client.request_deny_reasons"
+)
+
+// echoCaller answers the authorized requests
+var echoCaller = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(Result{Client: "ok"})
+})
+
+func TestOPAAuthz(t *testing.T) {
+	spiffetest.Chdir(t, "../../docker/privileged/opa")
+	ca := spiffetest.NewCA(t, "domain.test")
+	// other issues SVIDs of the same trust domain, unknown to the bundle
+	other := spiffetest.NewCA(t, "domain.test")
+	peer := func(spiffeID string) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: ca.MintX509SVID(spiffeID, time.Hour).Certificates}
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		tls        *tls.ConnectionState
+		wantStatus int
+		wantReason string
+	}{
+		{
+			name:       "authorized",
+			method:     http.MethodGet,
+			path:       "/getdata",
+			tls:        peer("spiffe://domain.test/api-server"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "method denied",
+			method:     http.MethodPost,
+			path:       "/getdata",
+			tls:        peer("spiffe://domain.test/api-server"),
+			wantStatus: http.StatusForbidden,
+			wantReason: "OPA denied request: spiffe://domain.test/api-server may not POST /getdata",
+		},
+		{
+			name:       "path denied",
+			method:     http.MethodGet,
+			path:       "/metrics",
+			tls:        peer("spiffe://domain.test/api-server"),
+			wantStatus: http.StatusForbidden,
+			wantReason: "OPA denied request: spiffe://domain.test/api-server may not GET /metrics",
+		},
+		{
+			name:       "caller denied",
+			method:     http.MethodGet,
+			path:       "/getdata",
+			tls:        peer("spiffe://domain.test/external"),
+			wantStatus: http.StatusForbidden,
+			wantReason: "OPA denied request: spiffe://domain.test/external may not GET /getdata",
+		},
+		{
+			name:       "no SVID",
+			method:     http.MethodGet,
+			path:       "/getdata",
+			wantStatus: http.StatusUnauthorized,
+			wantReason: "no SPIFFE ID: the caller presented neither a X509-SVID nor a JWT-SVID",
+		},
+		{
+			name:       "certificate without SPIFFE ID",
+			method:     http.MethodGet,
+			path:       "/getdata",
+			tls:        &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}},
+			wantStatus: http.StatusUnauthorized,
+			wantReason: "invalid peer X509-SVID: x509svid: could not get leaf SPIFFE ID: certificate contains no URI SAN",
+		},
+		{
+			name:       "certificate not verified",
+			method:     http.MethodGet,
+			path:       "/getdata",
+			tls:        &tls.ConnectionState{PeerCertificates: other.MintX509SVID("spiffe://domain.test/api-server", time.Hour).Certificates},
+			wantStatus: http.StatusUnauthorized,
+			wantReason: "invalid peer X509-SVID: x509svid: could not verify leaf certificate: x509: certificate signed by unknown authority (possibly because of \"x509: ECDSA verification failure\" while trying to verify candidate authority certificate \"domain.test CA\")",
+		},
+	}
+	handler := OPAAuthz(requestRule, requestDenyReasonsRule, ca.Bundle())(echoCaller)
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.TLS = tt.tls
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var got Result
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: unable to decode response: %v", tt.name, err)
+		}
+		if w.Code != tt.wantStatus || got.Reason != tt.wantReason {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, w.Code, got.Reason, tt.wantStatus, tt.wantReason)
+		}
+	}
+}
+
+// TestOPAAuthzWithJWT authorizes the caller authenticated by JWTAuth
+func TestOPAAuthzWithJWT(t *testing.T) {
+	spiffetest.Chdir(t, "../../docker/privileged/opa")
+	ca := spiffetest.NewCA(t, "domain.test")
+	handler := JWTAuth(ca.JWTBundle(), []string{"privileged"})(OPAAuthz(requestRule, requestDenyReasonsRule, ca.Bundle())(echoCaller))
+
+	for path, want := range map[string]int{"/connect": http.StatusOK, "/metrics": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+ca.MintJWTSVID("spiffe://domain.test/api-server", []string{"privileged"}, time.Hour))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestRequestInput(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/getdata?ward=a&ward=b", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Add("X-Request-Id", "42")
+
+	want := map[string]interface{}{
+		"peerID":  "spiffe://domain.test/api-server",
+		"method":  "GET",
+		"path":    "/getdata",
+		"headers": map[string]interface{}{"x-request-id": []interface{}{"42"}},
+		"query":   map[string]interface{}{"ward": []interface{}{"a", "b"}},
+	}
+	if got := requestInput(req, "spiffe://domain.test/api-server"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v without credentials", got, want)
+	}
+}
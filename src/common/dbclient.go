@@ -0,0 +1,137 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// DBClient serves the HTTP API of a workload calling the db server, e.g. the
+// privileged, restricted and external ones. Its SPIFFE ID is the one of the
+// X509-SVID of Source.
+type DBClient struct {
+	// Pool holds the connections to the db server
+	Pool *Pool
+	// Source provides the SVID of the workload, reported in the results
+	Source x509svid.Source
+	// ExpectedID is the SPIFFE ID the workload must be issued, empty for any
+	ExpectedID string
+}
+
+// CurrentSVID returns the SVID of the workload. It fails if the SPIFFE ID
+// is not the expected one, e.g. because of a wrong registration entry.
+func (c *DBClient) CurrentSVID() (*x509svid.SVID, error) {
+	svid, err := c.Source.GetX509SVID()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get X509-SVID: %v", err)
+	}
+	if c.ExpectedID != "" && svid.ID.String() != c.ExpectedID {
+		return nil, fmt.Errorf("workload was issued SPIFFE ID %v, expected %v", svid.ID, c.ExpectedID)
+	}
+	return svid, nil
+}
+
+// newResult returns a result describing the current SVID of the workload,
+// which may have been rotated since the last request
+func (c *DBClient) newResult() (Result, error) {
+	svid, err := c.CurrentSVID()
+	if err != nil {
+		return Result{}, err
+	}
+
+	expiry := svid.Certificates[0].NotAfter
+	return Result{
+		Client:      svid.ID.String(),
+		TrustDomain: svid.ID.TrustDomain().String(),
+		SVIDExpiry:  &expiry,
+	}, nil
+}
+
+// HandleConnect greets the db server and reports whether the connection was
+// authorized
+func (c *DBClient) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	result, err := c.newResult()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Invalid workload identity", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		result.Reason = err.Error()
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	conn, err := c.Pool.Get(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to connect to the db server", "error", err)
+		w.WriteHeader(HTTPStatus(err))
+		result.ConnectionStatus = "Not Created"
+		result.Reason = err.Error()
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	defer conn.Close()
+
+	// Send a message to the server using the TLS connection
+	err = WriteCommand(r.Context(), conn, "Hello server")
+	var msg string
+	if err == nil {
+		msg, err = ReadData(r.Context(), conn, result.Client)
+	}
+	if err != nil {
+		// The connection may be left mid-response, don't reuse it
+		conn.Discard()
+		w.WriteHeader(HTTPStatus(err))
+		result.ConnectionStatus = "Not Created"
+		result.Reason = strings.TrimSpace(err.Error())
+	} else {
+		slog.InfoContext(r.Context(), "DB Server says", "message", strings.TrimSpace(msg))
+		w.WriteHeader(http.StatusOK)
+		message := fmt.Sprintf("OPA allowed request: %v", strings.TrimSpace(msg))
+		result.ConnectionStatus = "Created"
+		result.Reason = message
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleGetData reads the patients from the db server
+func (c *DBClient) HandleGetData(w http.ResponseWriter, r *http.Request) {
+	result, err := c.newResult()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Invalid workload identity", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		result.Reason = err.Error()
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	conn, err := c.Pool.Get(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Unable to connect to the db server", "error", err)
+		w.WriteHeader(HTTPStatus(err))
+		result.Reason = err.Error()
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	defer conn.Close()
+
+	// Send a message to the server using the TLS connection
+	err = WriteCommand(r.Context(), conn, "/getdata")
+	var msg []Patient
+	if err == nil {
+		msg, err = ReadDataJSON(r.Context(), conn, result.Client)
+	}
+	if err != nil {
+		// The connection may be left mid-response, don't reuse it
+		conn.Discard()
+		w.WriteHeader(HTTPStatus(err))
+		result.Reason = strings.TrimSpace(err.Error())
+	} else {
+		slog.InfoContext(r.Context(), "DB Server says", "patients", len(msg))
+		w.WriteHeader(http.StatusOK)
+		result.Patients = msg
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+)
+
+func TestCurrentSVIDRotatedToAnotherID(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	api := spiffetest.NewWorkloadAPI(t, ca, "spiffe://domain.test/privileged")
+	source, err := NewX509Source(context.Background(), WithSocketPath(api.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	client := &DBClient{Source: source, ExpectedID: "spiffe://domain.test/privileged"}
+	if _, err := client.CurrentSVID(); err != nil {
+		t.Fatalf("got %v before the rotation", err)
+	}
+
+	api.SetIDs("spiffe://domain.test/restricted")
+	spiffetest.WaitFor(t, func() bool {
+		svid, _ := source.GetX509SVID()
+		return svid.ID.String() == "spiffe://domain.test/restricted"
+	})
+
+	_, err = client.CurrentSVID()
+	if err == nil || !strings.Contains(err.Error(), "expected spiffe://domain.test/privileged") {
+		t.Fatalf("got %v, want the SPIFFE ID mismatch", err)
+	}
+
+	// The rotated SVID is not used to call the db server either
+	rec := httptest.NewRecorder()
+	client.HandleConnect(rec, httptest.NewRequest(http.MethodGet, "/connect", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got HTTP %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Descriptions of the TLS alerts sent by a peer rejecting our SVID (RFC 8446,
+// section 6.2). crypto/tls reports a received alert as a *net.OpError of op
+// "remote error" wrapping an unexported type, whose message is the one of
+// tls.AlertError, e.g. "tls: bad certificate".
+var (
+	denialAlerts = map[string]bool{
+		"tls: bad certificate": true,
+		"tls: access denied":   true,
+	}
+	trustAlerts = map[string]bool{
+		"tls: unsupported certificate":       true,
+		"tls: revoked certificate":           true,
+		"tls: expired certificate":           true,
+		"tls: unknown certificate":           true,
+		"tls: unknown certificate authority": true,
+	}
+)
+
+// WorkloadAPIError means the X509-SVID or the bundles could not be fetched
+// from the Workload API, e.g. because the SPIRE agent socket is unavailable
+type WorkloadAPIError struct {
+	Err error
+}
+
+func (e *WorkloadAPIError) Error() string {
+	return fmt.Sprintf("Workload API unavailable: %v", e.Err)
+}
+
+func (e *WorkloadAPIError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeError means the connection or the mTLS handshake with the peer failed
+type HandshakeError struct {
+	Address string
+	Err     error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("mTLS handshake with %s failed: %v", e.Address, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// AuthorizationError means a policy denied the connection. The local policy
+// denied the peer, or, if Remote is set, the policy of the peer denied us.
+// DecisionID, Rule and Reasons are only known when the peer sent the reason of the denial.
+type AuthorizationError struct {
+	// PeerID is the SPIFFE ID that was denied
+	PeerID     string
+	Remote     bool
+	DecisionID string
+	Rule       string
+	// Reasons are the deny reasons of the policy, they are also part of Err
+	Reasons []string
+	Err     error
+}
+
+func (e *AuthorizationError) Error() string {
+	msg := e.Err.Error()
+	if e.Remote {
+		msg = "DB Server says => " + msg
+	}
+	if e.DecisionID != "" {
+		msg = fmt.Sprintf("%s (rule %s, decision %s)", msg, e.Rule, e.DecisionID)
+	}
+	return msg
+}
+
+func (e *AuthorizationError) Unwrap() error {
+	return e.Err
+}
+
+// TrustError means the SVID of the peer could not be verified against our
+// bundles or, if Remote is set, the peer could not verify our SVID
+type TrustError struct {
+	Remote bool
+	Err    error
+}
+
+func (e *TrustError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("DB Server says => untrusted SVID: %v", e.Err)
+	}
+	return fmt.Sprintf("untrusted peer SVID: %v", e.Err)
+}
+
+func (e *TrustError) Unwrap() error {
+	return e.Err
+}
+
+// IOError means reading from or writing to an established connection failed
+type IOError struct {
+	Op  string
+	Err error
+}
+
+func (e *IOError) Error() string {
+	return fmt.Sprintf("unable to %s: %v", e.Op, e.Err)
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// remoteAlertError converts a TLS alert sent by the peer into an
+// *AuthorizationError or a *TrustError. A bad_certificate alert is sent by
+// go-spiffe both when the policy and when the verification fails, it is
+// reported as a denial. It returns nil if err is not a TLS alert.
+func remoteAlertError(err error, peerID string) error {
+	var operr *net.OpError
+	if !errors.As(err, &operr) || operr.Op != "remote error" || operr.Err == nil {
+		return nil
+	}
+
+	switch description := operr.Err.Error(); {
+	case denialAlerts[description]:
+		return &AuthorizationError{PeerID: peerID, Remote: true, Err: fmt.Errorf("OPA denied request: unexpected peer ID %v", peerID)}
+	case trustAlerts[description]:
+		return &TrustError{Remote: true, Err: operr.Err}
+	default:
+		return nil
+	}
+}
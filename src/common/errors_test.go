@@ -0,0 +1,272 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+func TestRemoteAlertError(t *testing.T) {
+	const peerID = "spiffe://domain.test/privileged"
+	remote := func(alert uint8) error {
+		return &net.OpError{Op: "remote error", Err: tls.AlertError(alert)}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		// want is the type of the converted error, nil if err is not an alert of a rejected SVID
+		want error
+	}{
+		{"bad certificate", remote(42), &AuthorizationError{}},
+		{"access denied", remote(49), &AuthorizationError{}},
+		{"unsupported certificate", remote(43), &TrustError{}},
+		{"revoked certificate", remote(44), &TrustError{}},
+		{"expired certificate", remote(45), &TrustError{}},
+		{"unknown certificate", remote(46), &TrustError{}},
+		{"unknown CA", remote(48), &TrustError{}},
+		{"internal error", remote(80), nil},
+		{"local error", &net.OpError{Op: "local error", Err: tls.AlertError(42)}, nil},
+		{"read error", &net.OpError{Op: "read", Err: io.ErrUnexpectedEOF}, nil},
+		{"EOF", io.EOF, nil},
+	}
+	for _, tt := range tests {
+		err := remoteAlertError(tt.err, peerID)
+		switch want := tt.want.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: got %v, want nil", tt.name, err)
+			}
+		case *AuthorizationError:
+			if !errors.As(err, &want) || !want.Remote || want.PeerID != peerID {
+				t.Errorf("%s: got %#v, want a remote *AuthorizationError of %s", tt.name, err, peerID)
+			}
+		case *TrustError:
+			if !errors.As(err, &want) || !want.Remote {
+				t.Errorf("%s: got %#v, want a remote *TrustError", tt.name, err)
+			}
+		}
+	}
+}
+
+// TestRemoteAlertFromServer checks the alert sent by crypto/tls when the
+// server denies the client SVID. With TLS 1.3 the client sees it on the first read.
+func TestRemoteAlertFromServer(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr := startHelloServer(t,
+		WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		WithAuthorizer(func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+			return errors.New("denied")
+		}))
+
+	ctx := context.Background()
+	conn, err := CreateTLSDialer(ctx, addr,
+		WithX509Source(ca.X509Source("spiffe://domain.test/external")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := WriteCommand(ctx, conn, "Hello server"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadData(ctx, conn, "spiffe://domain.test/external")
+	var aerr *AuthorizationError
+	if !errors.As(err, &aerr) || !aerr.Remote {
+		t.Fatalf("got %v, want a remote *AuthorizationError", err)
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	serverOpts := []Option{
+		WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()),
+	}
+	addr := startHelloServer(t, serverOpts...)
+
+	// Nothing listens on closedAddr
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	// Servers failing the handshake: one never answering, one closing the
+	// connection once the ClientHello is read and one answering in plain text
+	silent := startRawServer(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	closing := startRawServer(t, func(conn net.Conn) { conn.Read(make([]byte, 64*1024)) })
+	plain := startRawServer(t, func(conn net.Conn) { io.WriteString(conn, "HTTP/1.0 400 Bad Request\r\n\r\n") })
+
+	client := WithX509Source(ca.X509Source("spiffe://domain.test/privileged"))
+	// The client of another CA of the same trust domain cannot verify the server
+	untrusted := WithX509Source(spiffetest.NewCA(t, "domain.test").X509Source("spiffe://domain.test/privileged"))
+	deny := WithAuthorizer(func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		return errors.New("unexpected peer ID")
+	})
+
+	tests := []struct {
+		name string
+		addr string
+		opts []Option
+		// want is a pointer to the expected error type
+		want interface{}
+	}{
+		{"invalid Workload API address", addr, []Option{WithSocketPath("tcp://localhost")}, new(*WorkloadAPIError)},
+		{"Workload API unavailable", addr, []Option{WithSocketPath("unix:///nonexistent/agent.sock")}, new(*WorkloadAPIError)},
+		{"server unreachable", closedAddr, []Option{client, WithAuthorizer(tlsconfig.AuthorizeAny())}, new(*HandshakeError)},
+		{"handshake timeout", silent, []Option{client, WithAuthorizer(tlsconfig.AuthorizeAny())}, new(*HandshakeError)},
+		{"closed during handshake", closing, []Option{client, WithAuthorizer(tlsconfig.AuthorizeAny())}, new(*HandshakeError)},
+		{"not TLS", plain, []Option{client, WithAuthorizer(tlsconfig.AuthorizeAny())}, new(*HandshakeError)},
+		{"server untrusted", addr, []Option{untrusted, WithAuthorizer(tlsconfig.AuthorizeAny())}, new(*TrustError)},
+		{"server denied", addr, []Option{client, deny}, new(*AuthorizationError)},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		conn, err := CreateTLSDialer(ctx, tt.addr, tt.opts...)
+		cancel()
+		if conn != nil {
+			conn.Close()
+		}
+		if !errors.As(err, tt.want) {
+			t.Errorf("%s: got %T %v, want %T", tt.name, err, err, reflect.ValueOf(tt.want).Elem().Interface())
+		}
+	}
+}
+
+// startRawServer serves TCP connections with handle until the end of the
+// test and returns its address. The connections are closed once handled.
+func startRawServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestReadDataErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     error
+	}{
+		{
+			name:     "throttled",
+			response: "ERR THROTTLED rate limit exceeded for spiffe://domain.test/external (1/s)\n",
+			want:     &ProtocolError{Status: StatusThrottled, Message: "rate limit exceeded for spiffe://domain.test/external (1/s)"},
+		},
+		{
+			name:     "denied",
+			response: "ERR DENIED OPA denied request: external is blocked on Mondays\tdecision_id=42\treasons=[\"external is blocked on Mondays\"]\trule=data.example.allow\n",
+			want: &AuthorizationError{
+				PeerID:     "spiffe://domain.test/external",
+				Remote:     true,
+				DecisionID: "42",
+				Rule:       "data.example.allow",
+				Reasons:    []string{"external is blocked on Mondays"},
+				Err:        errors.New("OPA denied request: external is blocked on Mondays"),
+			},
+		},
+		{
+			name: "closed",
+			want: &IOError{Op: "read response", Err: io.EOF},
+		},
+	}
+	for _, tt := range tests {
+		srvConn, cliConn := net.Pipe()
+		go func() {
+			io.WriteString(srvConn, tt.response)
+			srvConn.Close()
+		}()
+
+		_, err := ReadData(context.Background(), cliConn, "spiffe://domain.test/external")
+		cliConn.Close()
+		if !reflect.DeepEqual(err, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{&AuthorizationError{Err: errors.New("denied")}, http.StatusForbidden},
+		{&AuthorizationError{Remote: true, Err: errors.New("denied")}, http.StatusForbidden},
+		{&WorkloadAPIError{Err: errors.New("no agent")}, http.StatusServiceUnavailable},
+		{&HandshakeError{Address: "db:8082", Err: errors.New("refused")}, http.StatusServiceUnavailable},
+		{ErrPoolClosed, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w, 10 connections in use: %v", ErrPoolExhausted, context.DeadlineExceeded), http.StatusServiceUnavailable},
+		{&TrustError{Err: errors.New("unknown CA")}, http.StatusBadGateway},
+		{&IOError{Op: "read response", Err: io.EOF}, http.StatusBadGateway},
+		{errors.New("unable to decode patients"), http.StatusBadGateway},
+		{&ProtocolError{Status: StatusDenied}, http.StatusForbidden},
+		{&ProtocolError{Status: StatusThrottled}, http.StatusTooManyRequests},
+		{&ProtocolError{Status: StatusIdleTimeout}, http.StatusGatewayTimeout},
+		{&ProtocolError{Status: StatusRequestTimeout}, http.StatusGatewayTimeout},
+		{&ProtocolError{Status: StatusRequestTooLarge}, http.StatusRequestEntityTooLarge},
+		{&ProtocolError{Status: StatusInternal}, http.StatusInternalServerError},
+		{fmt.Errorf("getdata: %w", &ProtocolError{Status: StatusThrottled}), http.StatusTooManyRequests},
+		{fmt.Errorf("connect: %w", &WorkloadAPIError{Err: errors.New("no agent")}), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if got := HTTPStatus(tt.err); got != tt.want {
+			t.Errorf("HTTPStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	denied := errors.New("OPA denied request: external is blocked on Mondays")
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&WorkloadAPIError{Err: errors.New("no agent")}, "Workload API unavailable: no agent"},
+		{&HandshakeError{Address: "db:8082", Err: errors.New("refused")}, "mTLS handshake with db:8082 failed: refused"},
+		{&AuthorizationError{Err: denied}, "OPA denied request: external is blocked on Mondays"},
+		{&AuthorizationError{Remote: true, Err: denied}, "DB Server says => OPA denied request: external is blocked on Mondays"},
+		{&AuthorizationError{Remote: true, DecisionID: "42", Rule: "data.example.allow", Err: denied}, "DB Server says => OPA denied request: external is blocked on Mondays (rule data.example.allow, decision 42)"},
+		{&TrustError{Err: errors.New("unknown CA")}, "untrusted peer SVID: unknown CA"},
+		{&TrustError{Remote: true, Err: errors.New("unknown CA")}, "DB Server says => untrusted SVID: unknown CA"},
+		{&IOError{Op: "read response", Err: io.EOF}, "unable to read response: EOF"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+		if errors.Unwrap(tt.err) == nil {
+			t.Errorf("%T does not unwrap its cause", tt.err)
+		}
+	}
+}
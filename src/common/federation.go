@@ -0,0 +1,189 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/federation"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// defaultBundleRefresh is the refresh period of a bundle endpoint without refresh hint
+const defaultBundleRefresh = 5 * time.Minute
+
+// FederatedBundles holds the X509 bundles of foreign trust domains loaded from
+// files or fetched from SPIFFE bundle endpoints. The bundles of the trust
+// domains federated through SPIRE are already provided by the Workload API.
+type FederatedBundles struct {
+	mu      sync.RWMutex
+	bundles map[spiffeid.TrustDomain]*x509bundle.Bundle
+}
+
+// NewFederatedBundles returns an empty set of federated bundles
+func NewFederatedBundles() *FederatedBundles {
+	return &FederatedBundles{bundles: map[spiffeid.TrustDomain]*x509bundle.Bundle{}}
+}
+
+// Load loads the bundle of a trust domain from a file, either a SPIFFE bundle
+// (.json) or PEM encoded CA certificates
+func (f *FederatedBundles) Load(trustDomain, path string) error {
+	td, err := spiffeid.TrustDomainFromString(trustDomain)
+	if err != nil {
+		return fmt.Errorf("invalid trust domain %q: %v", trustDomain, err)
+	}
+
+	var bundle *x509bundle.Bundle
+	if filepath.Ext(path) == ".json" {
+		b, err := spiffebundle.Load(td, path)
+		if err != nil {
+			return fmt.Errorf("unable to load SPIFFE bundle of %v: %v", td, err)
+		}
+		bundle = b.X509Bundle()
+	} else {
+		bundle, err = x509bundle.Load(td, path)
+		if err != nil {
+			return fmt.Errorf("unable to load X509 bundle of %v: %v", td, err)
+		}
+	}
+
+	f.set(bundle)
+	return nil
+}
+
+// Watch keeps the bundle of a trust domain up to date from its SPIFFE bundle
+// endpoint until ctx is done. The endpoint is authenticated with the SPIFFE
+// ID endpointID and the bundles of source, or with the Web PKI if endpointID is empty.
+func (f *FederatedBundles) Watch(ctx context.Context, trustDomain, url, endpointID string, source x509bundle.Source) error {
+	td, err := spiffeid.TrustDomainFromString(trustDomain)
+	if err != nil {
+		return fmt.Errorf("invalid trust domain %q: %v", trustDomain, err)
+	}
+
+	var options []federation.FetchOption
+	if endpointID != "" {
+		id, err := spiffeid.FromString(endpointID)
+		if err != nil {
+			return fmt.Errorf("invalid bundle endpoint SPIFFE ID %q: %v", endpointID, err)
+		}
+		options = append(options, federation.WithSPIFFEAuth(source, id))
+	}
+
+	go func() {
+		err := federation.WatchBundle(ctx, td, url, bundleWatcher{f: f, td: td}, options...)
+		slog.Info("stopped watching bundle endpoint", "trust_domain", td.String(), "url", url, "error", err)
+	}()
+	return nil
+}
+
+// GetX509BundleForTrustDomain returns the bundle of a federated trust domain
+func (f *FederatedBundles) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	bundle, ok := f.bundles[td]
+	if !ok {
+		return nil, fmt.Errorf("no federated bundle for trust domain %q", td)
+	}
+	return bundle, nil
+}
+
+func (f *FederatedBundles) set(bundle *x509bundle.Bundle) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bundles[bundle.TrustDomain()] = bundle
+}
+
+// bundleWatcher updates a federated bundle fetched from a bundle endpoint
+type bundleWatcher struct {
+	f  *FederatedBundles
+	td spiffeid.TrustDomain
+}
+
+func (w bundleWatcher) NextRefresh(refreshHint time.Duration) time.Duration {
+	if refreshHint > 0 {
+		return refreshHint
+	}
+	return defaultBundleRefresh
+}
+
+func (w bundleWatcher) OnUpdate(bundle *spiffebundle.Bundle) {
+	slog.Info("federated bundle updated", "trust_domain", w.td.String())
+	w.f.set(bundle.X509Bundle())
+}
+
+func (w bundleWatcher) OnError(err error) {
+	slog.Warn("unable to fetch federated bundle", "trust_domain", w.td.String(), "error", err)
+}
+
+// WithFederated returns a source looking up the bundles in source, which holds
+// those of the Workload API, then in federated, e.g. to build a tls.Config
+func WithFederated(source X509Source, federated x509bundle.Source) X509Source {
+	return federatedSource{X509Source: source, federated: federated}
+}
+
+// federatedSource looks up the bundles in the X509 source, then in the federated bundles
+type federatedSource struct {
+	X509Source
+	federated x509bundle.Source
+}
+
+func (s federatedSource) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	bundle, err := s.X509Source.GetX509BundleForTrustDomain(td)
+	if err == nil {
+		return bundle, nil
+	}
+	if fbundle, ferr := s.federated.GetX509BundleForTrustDomain(td); ferr == nil {
+		return fbundle, nil
+	}
+	return nil, err
+}
+
+// NewFederatedBundlesFromFlags loads the bundles of a comma separated list of
+// td=path entries and watches the bundle endpoints of a comma separated list of
+// td=url entries. An endpoint authenticated with SPIFFE is given as
+// td=url|spiffe-id, its SVID is verified with the bundles of source. It
+// returns nil if both lists are empty.
+func NewFederatedBundlesFromFlags(ctx context.Context, bundles, endpoints string, source x509bundle.Source) (*FederatedBundles, error) {
+	if bundles == "" && endpoints == "" {
+		return nil, nil
+	}
+
+	f := NewFederatedBundles()
+	for _, entry := range splitList(bundles) {
+		td, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid federated bundle %q, expected td=path", entry)
+		}
+		if err := f.Load(td, path); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range splitList(endpoints) {
+		td, endpoint, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid bundle endpoint %q, expected td=url or td=url|spiffe-id", entry)
+		}
+		url, endpointID, _ := strings.Cut(endpoint, "|")
+		if err := f.Watch(ctx, td, url, endpointID, source); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func splitList(s string) []string {
+	var r []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
@@ -0,0 +1,210 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// federatedPolicy allows the workloads of domain.test and partner.test as
+// long as only those of partner.test are reported as federated
+const federatedPolicy = `package example
+
+default allow = false
+
+allow {
+    input.trustDomain == "domain.test"
+    not input.federated
+}
+
+allow {
+    input.trustDomain == "partner.test"
+    input.federated
+}
+`
+
+// writeBundles writes the bundle of ca to dir both as PEM and as a SPIFFE bundle
+func writeBundles(t *testing.T, ca *spiffetest.CA, dir string) (pemFile, jsonFile string) {
+	t.Helper()
+	_, _, pemFile = ca.WriteX509SVID(dir, ca.TrustDomain().ID().String()+"/app")
+
+	data, err := spiffebundle.FromX509Bundle(ca.Bundle()).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFile = filepath.Join(dir, "bundle.json")
+	if err := os.WriteFile(jsonFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pemFile, jsonFile
+}
+
+func TestFederatedBundlesLoad(t *testing.T) {
+	partner := spiffetest.NewCA(t, "partner.test")
+	pemFile, jsonFile := writeBundles(t, partner, t.TempDir())
+	td := partner.TrustDomain()
+
+	for _, path := range []string{pemFile, jsonFile} {
+		f := NewFederatedBundles()
+		if err := f.Load("partner.test", path); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		bundle, err := f.GetX509BundleForTrustDomain(td)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !sameRoots(bundle, partner.Bundle()) {
+			t.Errorf("%s: got %d roots, want those of the partner CA", path, len(bundle.X509Roots()))
+		}
+		if _, err := f.GetX509BundleForTrustDomain(spiffeid.RequireTrustDomainFromString("other.test")); err == nil {
+			t.Errorf("%s: got a bundle for a trust domain not loaded", path)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		trustDomain string
+		path        string
+	}{
+		{"invalid trust domain", "", pemFile},
+		{"missing file", "partner.test", filepath.Join(t.TempDir(), "missing.pem")},
+		{"not a SPIFFE bundle", "partner.test", writeFile(t, "bundle.json", "not json")},
+		{"not PEM", "partner.test", writeFile(t, "bundle.pem", "not pem")},
+	}
+	for _, tt := range tests {
+		if err := NewFederatedBundles().Load(tt.trustDomain, tt.path); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
+
+func TestWithFederated(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	partner := spiffetest.NewCA(t, "partner.test")
+	pemFile, _ := writeBundles(t, partner, t.TempDir())
+
+	federated := NewFederatedBundles()
+	if err := federated.Load("partner.test", pemFile); err != nil {
+		t.Fatal(err)
+	}
+	source := WithFederated(ca.X509Source("spiffe://domain.test/db-server"), federated)
+
+	if bundle, err := source.GetX509BundleForTrustDomain(ca.TrustDomain()); err != nil || !sameRoots(bundle, ca.Bundle()) {
+		t.Errorf("got %v, %v, want the local bundle", bundle, err)
+	}
+	if bundle, err := source.GetX509BundleForTrustDomain(partner.TrustDomain()); err != nil || !sameRoots(bundle, partner.Bundle()) {
+		t.Errorf("got %v, %v, want the federated bundle", bundle, err)
+	}
+	if _, err := source.GetX509BundleForTrustDomain(spiffeid.RequireTrustDomainFromString("other.test")); err == nil {
+		t.Error("got a bundle for a trust domain neither local nor federated")
+	}
+	if svid, err := source.GetX509SVID(); err != nil || svid.ID.String() != "spiffe://domain.test/db-server" {
+		t.Errorf("got %v, %v, want the SVID of the source", svid, err)
+	}
+}
+
+func TestNewFederatedBundlesFromFlags(t *testing.T) {
+	partner := spiffetest.NewCA(t, "partner.test")
+	pemFile, _ := writeBundles(t, partner, t.TempDir())
+
+	f, err := NewFederatedBundlesFromFlags(context.Background(), "", "", nil)
+	if f != nil || err != nil {
+		t.Errorf("got %v, %v without bundles nor endpoints, want nil", f, err)
+	}
+
+	f, err = NewFederatedBundlesFromFlags(context.Background(), " partner.test="+pemFile+", ", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetX509BundleForTrustDomain(partner.TrustDomain()); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tests := []struct {
+		name      string
+		bundles   string
+		endpoints string
+	}{
+		{"bundle without trust domain", pemFile, ""},
+		{"missing bundle", "partner.test=" + filepath.Join(t.TempDir(), "missing.pem"), ""},
+		{"endpoint without trust domain", "", "https://partner.test/bundle"},
+		{"invalid endpoint SPIFFE ID", "", "partner.test=https://partner.test/bundle|partner.test"},
+	}
+	for _, tt := range tests {
+		if _, err := NewFederatedBundlesFromFlags(ctx, tt.bundles, tt.endpoints, nil); err == nil {
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
+
+// TestFederatedInput checks that a listener fetching its SVID from the Workload
+// API tells OPA which clients are federated
+func TestFederatedInput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "policy.rego"), []byte(federatedPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spiffetest.Chdir(t, dir)
+
+	ca := spiffetest.NewCA(t, "domain.test")
+	partner := spiffetest.NewCA(t, "partner.test")
+	pemFile, _ := writeBundles(t, partner, t.TempDir())
+	federated := NewFederatedBundles()
+	if err := federated.Load("partner.test", pemFile); err != nil {
+		t.Fatal(err)
+	}
+
+	api := spiffetest.NewWorkloadAPI(t, ca, "spiffe://domain.test/db-server")
+	addr := startHelloServer(t, WithSocketPath(api.Addr()), WithFederatedBundles(federated))
+
+	sources := map[string]X509Source{
+		"local":     ca.X509Source("spiffe://domain.test/privileged"),
+		"federated": spiffetest.X509Source{SVID: partner.MintX509SVID("spiffe://partner.test/app", time.Hour), Bundle: ca.Bundle()},
+	}
+	for name, source := range sources {
+		ctx := context.Background()
+		conn, err := CreateTLSDialer(ctx, addr, WithX509Source(source), WithAuthorizer(tlsconfig.AuthorizeAny()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := WriteCommand(ctx, conn, "Hello server"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := ReadData(ctx, conn, ""); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		conn.Close()
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sameRoots tells whether two bundles hold the same roots
+func sameRoots(a, b *x509bundle.Bundle) bool {
+	if len(a.X509Roots()) != len(b.X509Roots()) {
+		return false
+	}
+	for _, root := range b.X509Roots() {
+		if !a.HasX509Root(root) {
+			return false
+		}
+	}
+	return true
+}
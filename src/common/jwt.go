@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// jwtSVIDKey is the context key of the JWT-SVID validated by JWTAuth
+type jwtSVIDKey struct{}
+
+// LoadJWTBundle loads the JWT bundle of a trust domain from a JWKS file, to
+// validate JWT-SVIDs without the Workload API
+func LoadJWTBundle(trustDomain, path string) (*jwtbundle.Bundle, error) {
+	td, err := spiffeid.TrustDomainFromString(trustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust domain %q: %v", trustDomain, err)
+	}
+	bundle, err := jwtbundle.Load(td, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load JWT bundle: %v", err)
+	}
+	return bundle, nil
+}
+
+// JWTAuth is a middleware authenticating HTTP callers with a JWT-SVID sent as
+// a bearer token in the Authorization header. The token must be signed by a
+// key of bundles and be issued for one of audience. The caller is then
+// authorized with opa.AuthorizeHTTP, like mTLS peers are with Authorizer.
+func JWTAuth(bundles jwtbundle.Source, audience []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			token, ok := bearerToken(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAuthError(ctx, w, http.StatusUnauthorized, errors.New("missing JWT-SVID bearer token"))
+				return
+			}
+
+			svid, err := jwtsvid.ParseAndValidate(token, bundles, audience)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeAuthError(ctx, w, http.StatusUnauthorized, fmt.Errorf("invalid JWT-SVID: %v", err))
+				return
+			}
+
+			ctx = WithLogAttrs(ctx, "caller_id", svid.ID.String())
+			if err := opa.AuthorizeHTTP(ctx, svid.ID.String(), svid.Claims, r.Method, r.URL.Path); err != nil {
+				var denied *opa.DeniedError
+				if errors.As(err, &denied) {
+					writeAuthError(ctx, w, http.StatusForbidden, err)
+				} else {
+					writeAuthError(ctx, w, http.StatusInternalServerError, fmt.Errorf("unable to authorize caller: %v", err))
+				}
+				return
+			}
+
+			ctx = context.WithValue(ctx, jwtSVIDKey{}, svid)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// JWTSVIDFromContext returns the JWT-SVID of the caller validated by JWTAuth
+func JWTSVIDFromContext(ctx context.Context) (*jwtsvid.SVID, bool) {
+	svid, ok := ctx.Value(jwtSVIDKey{}).(*jwtsvid.SVID)
+	return svid, ok
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// writeAuthError rejects the request with a Result explaining why
+func writeAuthError(ctx context.Context, w http.ResponseWriter, status int, err error) {
+	slog.WarnContext(ctx, "HTTP caller rejected", "status", status, "error", err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Result{Reason: err.Error()})
+}
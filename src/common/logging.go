@@ -0,0 +1,106 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// logAttrsKey is the context key of the attributes added to every log record
+type logAttrsKey struct{}
+
+// InitLogging installs a default slog logger writing records to w. The format
+// is either "json" or "text" and level one of "debug", "info", "warn" or "error".
+// Every record carries the service name.
+func InitLogging(w io.Writer, format, level, service string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}).With("service", service))
+	return nil
+}
+
+// WithLogAttrs returns a context whose log records carry the given attributes
+// in addition to those already in ctx. Records must be logged with the
+// *Context variants of the slog functions, e.g. slog.InfoContext.
+func WithLogAttrs(ctx context.Context, args ...any) context.Context {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	attrs = append(attrs[:len(attrs):len(attrs)], argsToAttrs(args)...)
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// NewRequestID returns a random ID identifying a connection or a request
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the attributes stored by WithLogAttrs to the records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// argsToAttrs converts alternating keys and values to attributes
+func argsToAttrs(args []any) []slog.Attr {
+	var r slog.Record
+	r.Add(args...)
+
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return attrs
+}
+
+// RequestID is a middleware assigning an ID to each HTTP request. The ID sent
+// by the caller in the X-Request-Id header is reused if present. The ID is
+// echoed in the response and added to the log records of the request.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = NewRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+
+		ctx := WithLogAttrs(r.Context(), "request_id", id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
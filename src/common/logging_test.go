@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestInitLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var logs bytes.Buffer
+	if err := InitLogging(&logs, "json", "warn", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithLogAttrs(context.Background(), "conn_id", "c1", "peer_id", "spiffe://domain.test/external")
+	reqCtx := WithLogAttrs(ctx, "request_id", "r1")
+	slog.InfoContext(reqCtx, "Client says")
+	slog.WarnContext(reqCtx, "Throttled")
+	slog.ErrorContext(ctx, "Unable to read request")
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	want := []map[string]interface{}{
+		{"level": "WARN", "msg": "Throttled", "service": "db", "conn_id": "c1", "peer_id": "spiffe://domain.test/external", "request_id": "r1"},
+		{"level": "ERROR", "msg": "Unable to read request", "service": "db", "conn_id": "c1", "peer_id": "spiffe://domain.test/external"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d above the warn level:\n%s", len(records), len(want), logs.String())
+	}
+	for i, record := range records {
+		delete(record, "time")
+		if !reflect.DeepEqual(record, want[i]) {
+			t.Errorf("got record %v, want %v", record, want[i])
+		}
+	}
+}
+
+func TestInitLoggingErrors(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	tests := []struct {
+		format, level string
+	}{
+		{"xml", "info"},
+		{"json", "verbose"},
+	}
+	for _, tt := range tests {
+		if err := InitLogging(&bytes.Buffer{}, tt.format, tt.level, "db"); err == nil {
+			t.Errorf("format %q, level %q: got no error", tt.format, tt.level)
+		}
+	}
+}
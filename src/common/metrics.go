@@ -0,0 +1,154 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+)
+
+// Roles of a TLS connection used as metric labels
+const (
+	roleClient = "client"
+	roleServer = "server"
+)
+
+var (
+	// handshakeDuration observes the TLS handshake time by role and result
+	handshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spiffe_tls_handshake_duration_seconds",
+		Help:    "Time spent in the mTLS handshake, including peer authorization.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"role", "result"})
+
+	// activeConnections tracks the open mTLS connections by role
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spiffe_tls_active_connections",
+		Help: "Number of open mTLS connections.",
+	}, []string{"role"})
+
+	// poolConnections tracks the pooled connections by state (idle, in_use)
+	poolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "spiffe_pool_connections",
+		Help: "Number of connections owned by the connection pool.",
+	}, []string{"state"})
+
+	// poolEvictionsTotal counts the pooled connections closed by reason
+	poolEvictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spiffe_pool_evictions_total",
+		Help: "Number of pooled connections closed instead of being reused.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(handshakeDuration, activeConnections, poolConnections, poolEvictionsTotal)
+}
+
+// observeHandshake records the duration of a handshake started at start
+func observeHandshake(role string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	handshakeDuration.WithLabelValues(role, result).Observe(time.Since(start).Seconds())
+}
+
+// Handshake runs the TLS handshake of a connection accepted from a listener
+// created by CreateTLSLIstener and records its duration. The handshake
+// otherwise runs implicitly on the first read.
+func Handshake(conn net.Conn) error {
+	hs, ok := conn.(interface{ Handshake() error })
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	err := hs.Handshake()
+	observeHandshake(roleServer, start, err)
+	return err
+}
+
+// trackedConn is a TLS connection counted in the active connections gauge
+type trackedConn struct {
+	net.Conn
+	role      string
+	closer    io.Closer // optional resource released along with the connection
+	closeOnce sync.Once
+}
+
+func newTrackedConn(conn net.Conn, role string) *trackedConn {
+	activeConnections.WithLabelValues(role).Inc()
+	return &trackedConn{Conn: conn, role: role}
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		activeConnections.WithLabelValues(c.role).Dec()
+		if c.closer != nil {
+			c.closer.Close()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// Handshake runs the TLS handshake of the underlying connection
+func (c *trackedConn) Handshake() error {
+	if hs, ok := c.Conn.(interface{ Handshake() error }); ok {
+		return hs.Handshake()
+	}
+	return nil
+}
+
+// ConnectionState returns the TLS state of the underlying connection
+func (c *trackedConn) ConnectionState() tls.ConnectionState {
+	if cs, ok := c.Conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return cs.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// PeerID returns the peer SPIFFE ID so that spiffetls.PeerIDFromConn keeps
+// working, whether the connection was created by spiffetls or crypto/tls
+func (c *trackedConn) PeerID() (spiffeid.ID, error) {
+	if id, err := spiffetls.PeerIDFromConn(c.Conn); err == nil {
+		return id, nil
+	}
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return spiffeid.ID{}, errors.New("no peer certificates")
+	}
+	if len(certs[0].URIs) != 1 {
+		return spiffeid.ID{}, fmt.Errorf("invalid peer X509-SVID: %d URI SANs", len(certs[0].URIs))
+	}
+	return spiffeid.FromURI(certs[0].URIs[0])
+}
+
+// trackedListener wraps the accepted connections in a trackedConn. The
+// closer, if any, is closed along with the listener, e.g. its X509 source.
+type trackedListener struct {
+	net.Listener
+	closer io.Closer
+}
+
+func (l trackedListener) Close() error {
+	err := l.Listener.Close()
+	if l.closer != nil {
+		l.closer.Close()
+	}
+	return err
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newTrackedConn(conn, roleServer), nil
+}
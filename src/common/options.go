@@ -0,0 +1,188 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// DefaultSocketPath is the Workload API address used when neither WithSocketPath
+// nor the SPIFFE_ENDPOINT_SOCKET environment variable is set (SPIRE is used in this example).
+const DefaultSocketPath = "unix:///tmp/agent.sock"
+
+// Option configures CreateTLSDialer and CreateTLSLIstener
+type Option func(*options)
+
+type options struct {
+	socketPath string
+	source     X509Source
+	federated  x509bundle.Source
+	authorizer tlsconfig.Authorizer
+	policyDir  string
+}
+
+// X509Source provides the X509-SVID and the bundles used to authenticate connections
+type X509Source interface {
+	x509svid.Source
+	x509bundle.Source
+}
+
+// WithSocketPath sets the address of the Workload API, e.g. unix:///tmp/agent.sock.
+// An empty path is ignored so that flags can be passed through unconditionally.
+func WithSocketPath(path string) Option {
+	return func(o *options) {
+		if path != "" {
+			o.socketPath = path
+		}
+	}
+}
+
+// WithX509Source makes the dialer or listener use a long-lived source, typically
+// created once per service with NewX509Source. Without it, a new Workload API
+// client is created for every dial and listener.
+func WithX509Source(source X509Source) Option {
+	return func(o *options) {
+		o.source = source
+	}
+}
+
+// WithAuthorizer replaces the OPA authorizer run during the handshake, e.g. by
+// tlsconfig.AuthorizeAny() for a server authorizing the requests of its clients
+// so that it can tell them why they are denied.
+func WithAuthorizer(authorizer tlsconfig.Authorizer) Option {
+	return func(o *options) {
+		o.authorizer = authorizer
+	}
+}
+
+// WithPolicyDir makes the OPA authorizer read the policy from dir instead of
+// the working directory, e.g. for several clients running in the same process.
+func WithPolicyDir(dir string) Option {
+	return func(o *options) {
+		o.policyDir = dir
+	}
+}
+
+// WithFederatedBundles authenticates peers of foreign trust domains with the
+// given bundles, e.g. a FederatedBundles, in addition to the bundles of the
+// Workload API.
+func WithFederatedBundles(bundles x509bundle.Source) Option {
+	return func(o *options) {
+		o.federated = bundles
+	}
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.socketPath == "" {
+		o.socketPath = SocketPath()
+	}
+	if o.source != nil {
+		o.source = o.withFederated(o.source)
+	}
+	return o
+}
+
+// withFederated adds the federated bundles, if any, to the bundles of source
+func (o options) withFederated(source X509Source) X509Source {
+	if o.federated == nil {
+		return source
+	}
+	return WithFederated(source, o.federated)
+}
+
+// SocketPath returns the Workload API address from the SPIFFE_ENDPOINT_SOCKET
+// environment variable, or DefaultSocketPath if it is not set.
+func SocketPath() string {
+	if addr, ok := workloadapi.GetDefaultAddress(); ok && addr != "" {
+		return addr
+	}
+	return DefaultSocketPath
+}
+
+// authorizerFor returns the configured authorizer, or the OPA one of the role
+// tracing evaluations as part of ctx. Peers are federated if they are not
+// members of the trust domain of the SVID of source, which may be nil. The
+// policy is read from the directory of WithPolicyDir, if any.
+func (o options) authorizerFor(ctx context.Context, role opa.Role, source x509svid.Source) tlsconfig.Authorizer {
+	if o.authorizer != nil {
+		return o.authorizer
+	}
+	if o.policyDir != "" {
+		ctx = opa.WithPolicyDir(ctx, o.policyDir)
+	}
+	return Authorizer(ctx, role, TrustDomainOf(source))
+}
+
+// TrustDomainOf returns the trust domain of the SVID of source, or an empty
+// string if source is nil or has no SVID
+func TrustDomainOf(source x509svid.Source) string {
+	if source == nil {
+		return ""
+	}
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		return ""
+	}
+	return svid.ID.TrustDomain().String()
+}
+
+// sourceOptions returns the options creating an X509 source from the configured Workload API
+func (o options) sourceOptions() []workloadapi.X509SourceOption {
+	return []workloadapi.X509SourceOption{
+		workloadapi.WithClientOptions(workloadapi.WithAddr(o.socketPath)),
+	}
+}
+
+// NewX509Source creates a source fetching the X509-SVID and bundles from the
+// Workload API. The source keeps watching the Workload API so that rotated
+// SVIDs are picked up by the connections using it. It must be closed by the caller.
+// It returns a *WorkloadAPIError if the Workload API cannot be reached.
+func NewX509Source(ctx context.Context, opts ...Option) (*workloadapi.X509Source, error) {
+	o := newOptions(opts)
+	if err := workloadapi.ValidateAddress(o.socketPath); err != nil {
+		return nil, &WorkloadAPIError{Err: fmt.Errorf("invalid Workload API address: %v", err)}
+	}
+
+	source, err := workloadapi.NewX509Source(ctx, o.sourceOptions()...)
+	if err == nil {
+		// The source is returned without error if ctx expires before the first update
+		_, err = source.GetX509SVID()
+		if err != nil {
+			source.Close()
+		}
+	}
+	if err != nil {
+		return nil, &WorkloadAPIError{Err: fmt.Errorf("unable to create X509 source: %v", err)}
+	}
+	return source, nil
+}
+
+// NewJWTSource creates a source fetching the JWT bundles from the Workload API,
+// e.g. to validate the JWT-SVIDs of HTTP callers. It must be closed by the caller.
+// It returns a *WorkloadAPIError if the Workload API cannot be reached.
+func NewJWTSource(ctx context.Context, opts ...Option) (*workloadapi.JWTSource, error) {
+	o := newOptions(opts)
+	if err := workloadapi.ValidateAddress(o.socketPath); err != nil {
+		return nil, &WorkloadAPIError{Err: fmt.Errorf("invalid Workload API address: %v", err)}
+	}
+
+	source, err := workloadapi.NewJWTSource(ctx, workloadapi.WithClientOptions(workloadapi.WithAddr(o.socketPath)))
+	if err == nil && ctx.Err() != nil {
+		// Like NewX509Source, the source is returned without bundles if ctx expires first
+		source.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, &WorkloadAPIError{Err: fmt.Errorf("unable to create JWT source: %v", err)}
+	}
+	return source, nil
+}
@@ -0,0 +1,23 @@
+package common
+
+import "testing"
+
+func TestSocketPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		option string
+		env    string
+		want   string
+	}{
+		{"option", "unix:///run/spire/agent.sock", "unix:///tmp/env.sock", "unix:///run/spire/agent.sock"},
+		{"option without environment", "tcp://127.0.0.1:8081", "", "tcp://127.0.0.1:8081"},
+		{"environment", "", "unix:///tmp/env.sock", "unix:///tmp/env.sock"},
+		{"default", "", "", DefaultSocketPath},
+	}
+	for _, tt := range tests {
+		t.Setenv("SPIFFE_ENDPOINT_SOCKET", tt.env)
+		if got := newOptions([]Option{WithSocketPath(tt.option)}).socketPath; got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
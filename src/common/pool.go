@@ -0,0 +1,293 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// Reasons for evicting a pooled connection, used as metric labels
+const (
+	evictIdleTimeout      = "idle_timeout"
+	evictSVIDRotated      = "svid_rotated"
+	evictPeerUntrusted    = "peer_untrusted"
+	evictPeerUnauthorized = "peer_unauthorized"
+	evictUnhealthy        = "unhealthy"
+	evictDiscarded        = "discarded"
+	evictPoolFull         = "pool_full"
+	evictPoolClosed       = "pool_closed"
+)
+
+var (
+	// ErrPoolClosed is returned by Pool.Get once the pool is closed
+	ErrPoolClosed = errors.New("connection pool closed")
+	// ErrPoolExhausted is returned by Pool.Get when no connection is given
+	// back before the context is done while MaxOpen connections are in use
+	ErrPoolExhausted = errors.New("connection pool exhausted")
+)
+
+// PoolConfig configures a Pool
+type PoolConfig struct {
+	// MaxIdle is the maximum number of idle connections kept for reuse
+	MaxIdle int
+	// MaxOpen is the maximum number of connections open at once, 0 means unlimited
+	MaxOpen int
+	// IdleTimeout evicts connections idle for longer. It should be shorter
+	// than the idle timeout of the db server, 0 means no timeout.
+	IdleTimeout time.Duration
+}
+
+// DefaultPoolConfig is the configuration of the pool of the client
+var DefaultPoolConfig = PoolConfig{
+	MaxIdle:     2,
+	MaxOpen:     10,
+	IdleTimeout: 90 * time.Second,
+}
+
+// Pool keeps mTLS connections to the db server open for reuse. Before being
+// handed out again, an idle connection is checked to be alive, to still use
+// the current client SVID and to still authenticate and authorize the server.
+type Pool struct {
+	serverAddress string
+	cfg           PoolConfig
+	opts          []Option
+	source        X509Source
+	authorizer    func(context.Context) tlsconfig.Authorizer
+	sem           chan struct{} // limits the open connections, nil if unlimited
+
+	mu     sync.Mutex
+	idle   []*pooledConn
+	closed bool
+}
+
+// pooledConn is a connection owned by the pool
+type pooledConn struct {
+	net.Conn
+	svid      []byte // leaf certificate of the client SVID when the connection was dialed
+	idleSince time.Time
+}
+
+// NewPool creates a pool of connections to serverAddress dialed with CreateTLSDialer.
+// Pass WithX509Source so that connections are evicted when the SVID or the bundles rotate.
+func NewPool(serverAddress string, cfg PoolConfig, opts ...Option) *Pool {
+	o := newOptions(opts)
+	p := &Pool{
+		serverAddress: serverAddress,
+		cfg:           cfg,
+		opts:          opts,
+		source:        o.source,
+		authorizer: func(ctx context.Context) tlsconfig.Authorizer {
+			return o.authorizerFor(ctx, opa.RoleClient, o.source)
+		},
+	}
+	if cfg.MaxOpen > 0 {
+		p.sem = make(chan struct{}, cfg.MaxOpen)
+	}
+	return p
+}
+
+// Get returns a healthy idle connection or dials a new one. It blocks while
+// MaxOpen connections are in use and returns an error wrapping ErrPoolExhausted
+// if ctx is done first. The connection must be closed to give it back. Dial
+// errors are those of CreateTLSDialer.
+func (p *Pool) Get(ctx context.Context) (*PoolConn, error) {
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w, %d connections in use: %v", ErrPoolExhausted, p.cfg.MaxOpen, ctx.Err())
+		}
+	}
+
+	for {
+		pc, err := p.popIdle()
+		if err != nil {
+			p.release()
+			return nil, err
+		}
+		if pc == nil {
+			break
+		}
+		if reason := p.check(ctx, pc); reason != "" {
+			p.evict(pc, reason)
+			continue
+		}
+		poolConnections.WithLabelValues("in_use").Inc()
+		return &PoolConn{Conn: pc.Conn, pc: pc, pool: p}, nil
+	}
+
+	pc := &pooledConn{svid: p.currentSVID()}
+	conn, err := CreateTLSDialer(ctx, p.serverAddress, p.opts...)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	pc.Conn = conn
+	poolConnections.WithLabelValues("in_use").Inc()
+	return &PoolConn{Conn: pc.Conn, pc: pc, pool: p}, nil
+}
+
+// Close closes the idle connections. Connections in use are closed when given back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		poolConnections.WithLabelValues("idle").Dec()
+		p.evict(pc, evictPoolClosed)
+	}
+	return nil
+}
+
+// popIdle returns the most recently used idle connection, or nil if there is none
+func (p *Pool) popIdle() (*pooledConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	if len(p.idle) == 0 {
+		return nil, nil
+	}
+	pc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	poolConnections.WithLabelValues("idle").Dec()
+	return pc, nil
+}
+
+// put gives a connection back, it is closed if unusable or if the pool is full
+func (p *Pool) put(pc *pooledConn, unusable bool) {
+	poolConnections.WithLabelValues("in_use").Dec()
+	defer p.release()
+
+	reason := ""
+	p.mu.Lock()
+	switch {
+	case unusable:
+		reason = evictDiscarded
+	case p.closed:
+		reason = evictPoolClosed
+	case len(p.idle) >= p.cfg.MaxIdle:
+		reason = evictPoolFull
+	default:
+		pc.idleSince = time.Now()
+		p.idle = append(p.idle, pc)
+		poolConnections.WithLabelValues("idle").Inc()
+	}
+	p.mu.Unlock()
+
+	if reason != "" {
+		p.evict(pc, reason)
+	}
+}
+
+// release frees a slot for a new connection
+func (p *Pool) release() {
+	if p.sem != nil {
+		<-p.sem
+	}
+}
+
+func (p *Pool) evict(pc *pooledConn, reason string) {
+	poolEvictionsTotal.WithLabelValues(reason).Inc()
+	pc.Close()
+}
+
+// check returns why an idle connection cannot be reused, or an empty string
+func (p *Pool) check(ctx context.Context, pc *pooledConn) string {
+	if p.cfg.IdleTimeout > 0 && time.Since(pc.idleSince) > p.cfg.IdleTimeout {
+		return evictIdleTimeout
+	}
+	if svid := p.currentSVID(); svid != nil && !bytes.Equal(svid, pc.svid) {
+		return evictSVIDRotated
+	}
+
+	// Authenticate and authorize the server again, the bundles or the policy may have changed
+	cs, ok := pc.Conn.(interface{ ConnectionState() tls.ConnectionState })
+	if ok && p.source != nil {
+		id, chains, err := x509svid.Verify(cs.ConnectionState().PeerCertificates, p.source)
+		if err != nil {
+			return evictPeerUntrusted
+		}
+		if err := p.authorizer(ctx)(id, chains); err != nil {
+			return evictPeerUnauthorized
+		}
+	} else if ok {
+		id, err := spiffetls.PeerIDFromConn(pc.Conn)
+		if err != nil {
+			return evictPeerUntrusted
+		}
+		if err := p.authorizer(ctx)(id, cs.ConnectionState().VerifiedChains); err != nil {
+			return evictPeerUnauthorized
+		}
+	}
+
+	if !alive(pc.Conn) {
+		return evictUnhealthy
+	}
+	return ""
+}
+
+// currentSVID returns the leaf certificate of the client SVID, or nil if unknown
+func (p *Pool) currentSVID() []byte {
+	if p.source == nil {
+		return nil
+	}
+	svid, err := p.source.GetX509SVID()
+	if err != nil || len(svid.Certificates) == 0 {
+		return nil
+	}
+	return svid.Certificates[0].Raw
+}
+
+// alive reports whether an idle connection is still open. The db server only
+// writes to an idle connection to report that it is closing it, so any data
+// or error other than a timeout means the connection cannot be reused.
+func alive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// PoolConn is a connection borrowed from a Pool
+type PoolConn struct {
+	net.Conn
+	pc       *pooledConn
+	pool     *Pool
+	unusable bool
+	once     sync.Once
+}
+
+// Discard marks the connection as unusable, e.g. after an error left the
+// protocol in an unknown state. Close then closes it instead of giving it back.
+func (c *PoolConn) Discard() {
+	c.unusable = true
+}
+
+// Close gives the connection back to the pool
+func (c *PoolConn) Close() error {
+	c.once.Do(func() {
+		c.pool.put(c.pc, c.unusable)
+	})
+	return nil
+}
@@ -0,0 +1,233 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// newPoolSetup starts a hello server of domain.test and returns its address
+// along with the options of a client authorizing it with authorizer
+func newPoolSetup(t *testing.T, ca *spiffetest.CA, authorizer tlsconfig.Authorizer) (string, []Option) {
+	addr := startHelloServer(t,
+		WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()))
+	return addr, []Option{
+		WithX509Source(ca.X509Source("spiffe://domain.test/privileged")),
+		WithAuthorizer(authorizer),
+	}
+}
+
+// hello sends a command on a pooled connection and gives it back. It returns
+// the underlying connection to tell whether it was reused.
+func hello(t *testing.T, pool *Pool) net.Conn {
+	t.Helper()
+	ctx := context.Background()
+
+	conn, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := WriteCommand(ctx, conn, "Hello server"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadData(ctx, conn, ""); err != nil {
+		t.Fatal(err)
+	}
+	return conn.Conn
+}
+
+func evictions(reason string) float64 {
+	return testutil.ToFloat64(poolEvictionsTotal.WithLabelValues(reason))
+}
+
+func TestPoolReuse(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr, opts := newPoolSetup(t, ca, tlsconfig.AuthorizeAny())
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1}, opts...)
+	defer pool.Close()
+
+	if first, second := hello(t, pool), hello(t, pool); first != second {
+		t.Error("idle connection not reused")
+	}
+}
+
+func TestPoolMaxIdle(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr, opts := newPoolSetup(t, ca, tlsconfig.AuthorizeAny())
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1}, opts...)
+	defer pool.Close()
+
+	ctx := context.Background()
+	first, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := evictions(evictPoolFull)
+	first.Close()
+	second.Close()
+	if got := evictions(evictPoolFull); got != before+1 {
+		t.Errorf("got %v pool_full evictions, want %v", got, before+1)
+	}
+}
+
+func TestPoolEvictsDeadConnections(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+
+	// The server answers a single command then closes the connection
+	addr := startTLSServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+			fmt.Fprintln(conn, "Hello once")
+		}
+	}, WithX509Source(ca.X509Source("spiffe://domain.test/db-server")), WithAuthorizer(tlsconfig.AuthorizeAny()))
+
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1},
+		WithX509Source(ca.X509Source("spiffe://domain.test/privileged")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()))
+	defer pool.Close()
+
+	first := hello(t, pool)
+	time.Sleep(50 * time.Millisecond) // let the close reach the client
+
+	before := evictions(evictUnhealthy)
+	if second := hello(t, pool); second == first {
+		t.Error("closed connection reused")
+	}
+	if got := evictions(evictUnhealthy); got != before+1 {
+		t.Errorf("got %v unhealthy evictions, want %v", got, before+1)
+	}
+}
+
+func TestPoolEvictsOnSVIDRotation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr := startHelloServer(t,
+		WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()))
+
+	api := spiffetest.NewWorkloadAPI(t, ca, "spiffe://domain.test/privileged")
+	source, err := NewX509Source(context.Background(), WithSocketPath(api.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1}, WithX509Source(source), WithAuthorizer(tlsconfig.AuthorizeAny()))
+	defer pool.Close()
+
+	first := hello(t, pool)
+	svid, _ := source.GetX509SVID()
+	api.Rotate()
+	spiffetest.WaitFor(t, func() bool {
+		rotated, _ := source.GetX509SVID()
+		return rotated.Certificates[0].SerialNumber.Cmp(svid.Certificates[0].SerialNumber) != 0
+	})
+
+	before := evictions(evictSVIDRotated)
+	if second := hello(t, pool); second == first {
+		t.Error("connection using the previous SVID reused")
+	}
+	if got := evictions(evictSVIDRotated); got != before+1 {
+		t.Errorf("got %v svid_rotated evictions, want %v", got, before+1)
+	}
+}
+
+func TestPoolReauthorizesOnReuse(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+
+	var deny atomic.Bool
+	var calls atomic.Int32
+	addr, opts := newPoolSetup(t, ca, func(id spiffeid.ID, _ [][]*x509.Certificate) error {
+		calls.Add(1)
+		if deny.Load() {
+			return fmt.Errorf("unexpected peer ID %v", id)
+		}
+		return nil
+	})
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1}, opts...)
+	defer pool.Close()
+
+	first := hello(t, pool)
+	if second := hello(t, pool); second != first {
+		t.Fatal("idle connection not reused")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("server authorized %d times, want on the dial and on the reuse", got)
+	}
+
+	// The policy changed while the connection was idle
+	deny.Store(true)
+	before := evictions(evictPeerUnauthorized)
+	_, err := pool.Get(context.Background())
+	var aerr *AuthorizationError
+	if !errors.As(err, &aerr) || aerr.Remote {
+		t.Errorf("got %v, want a local authorization error", err)
+	}
+	if got := evictions(evictPeerUnauthorized); got != before+1 {
+		t.Errorf("got %v peer_unauthorized evictions, want %v", got, before+1)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr, opts := newPoolSetup(t, ca, tlsconfig.AuthorizeAny())
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1, MaxOpen: 1}, opts...)
+	defer pool.Close()
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = pool.Get(ctx)
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("got %v while MaxOpen connections are in use, want %v", err, ErrPoolExhausted)
+	}
+	if got := HTTPStatus(err); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for an exhausted pool, want %d", got, http.StatusServiceUnavailable)
+	}
+
+	conn.Close()
+	conn, err = pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("connection given back not handed out: %v", err)
+	}
+	conn.Close()
+}
+
+func TestPoolClosed(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr, opts := newPoolSetup(t, ca, tlsconfig.AuthorizeAny())
+	pool := NewPool(addr, PoolConfig{MaxIdle: 1}, opts...)
+
+	hello(t, pool)
+	before := evictions(evictPoolClosed)
+	pool.Close()
+	if got := evictions(evictPoolClosed); got != before+1 {
+		t.Errorf("got %v pool_closed evictions, want %v", got, before+1)
+	}
+	if _, err := pool.Get(context.Background()); err != ErrPoolClosed {
+		t.Errorf("got %v, want %v", err, ErrPoolClosed)
+	}
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// errorPrefix marks a line sent by the db server in place of a regular response
+const errorPrefix = "ERR "
+
+// Statuses reported by the db server in a protocol error
+const (
+	// StatusThrottled means the workload exceeded its rate or connection quota
+	StatusThrottled = "THROTTLED"
+	// StatusInternal means the server failed to process the request
+	StatusInternal = "INTERNAL"
+	// StatusIdleTimeout means the connection was idle for too long and got closed
+	StatusIdleTimeout = "IDLE_TIMEOUT"
+	// StatusRequestTimeout means the request was not received within the request deadline
+	StatusRequestTimeout = "REQUEST_TIMEOUT"
+	// StatusRequestTooLarge means the request exceeded the maximum request size
+	StatusRequestTooLarge = "REQUEST_TOO_LARGE"
+	// StatusDenied means the policy of the server denied the workload
+	StatusDenied = "DENIED"
+)
+
+// ProtocolError is an error reported by the db server
+type ProtocolError struct {
+	Status  string
+	Message string
+	// Details holds the key=value fields sent after the message, if any
+	Details map[string]string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("DB Server says => %s: %s", e.Status, e.Message)
+}
+
+// HTTPStatus returns the HTTP status code to report for an error returned by
+// CreateTLSDialer, Pool.Get, ReadData or ReadDataJSON
+func HTTPStatus(err error) int {
+	var (
+		perr  *ProtocolError
+		aerr  *AuthorizationError
+		wlerr *WorkloadAPIError
+		hserr *HandshakeError
+	)
+	switch {
+	case errors.As(err, &aerr):
+		return http.StatusForbidden
+	case errors.As(err, &wlerr), errors.As(err, &hserr), errors.Is(err, ErrPoolClosed), errors.Is(err, ErrPoolExhausted):
+		return http.StatusServiceUnavailable
+	case !errors.As(err, &perr):
+		// TrustError, IOError and malformed responses
+		return http.StatusBadGateway
+	}
+
+	switch perr.Status {
+	case StatusDenied:
+		return http.StatusForbidden
+	case StatusThrottled:
+		return http.StatusTooManyRequests
+	case StatusIdleTimeout, StatusRequestTimeout:
+		return http.StatusGatewayTimeout
+	case StatusRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteError sends a protocol error to the client
+func WriteError(w io.Writer, status, message string) error {
+	return writeError(w, status, message, nil)
+}
+
+// WriteDenial tells the client why the policy denied it. The decision ID, the
+// rule and the reasons given by the policy are sent as details of a DENIED
+// protocol error, the reasons as a JSON array.
+func WriteDenial(w io.Writer, decisionID, rule, message string, reasons []string) error {
+	details := map[string]string{
+		"decision_id": decisionID,
+		"rule":        rule,
+	}
+	if len(reasons) > 0 {
+		bs, err := json.Marshal(reasons)
+		if err != nil {
+			return err
+		}
+		details["reasons"] = string(bs)
+	}
+	return writeError(w, StatusDenied, message, details)
+}
+
+// writeError sends a protocol error line, the details are appended as tab
+// separated key=value fields like the trace context of a command
+func writeError(w io.Writer, status, message string, details map[string]string) error {
+	keys := make([]string, 0, len(details))
+	for k := range details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%s %s", errorPrefix, status, strings.NewReplacer("\n", " ", "\t", " ").Replace(message))
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\t%s=%s", k, details[k])
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteCommand sends a command to the db server. The trace context of ctx is
+// appended to the command as tab separated key=value fields.
+func WriteCommand(ctx context.Context, w io.Writer, cmd string) error {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	keys := carrier.Keys()
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(cmd)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\t%s=%s", k, carrier.Get(k))
+	}
+	b.WriteString("\n")
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return &IOError{Op: "send command", Err: err}
+	}
+	return nil
+}
+
+// ParseCommand splits a request line sent with WriteCommand into the command
+// and a context carrying the trace context of the client.
+func ParseCommand(ctx context.Context, line string) (context.Context, string) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+
+	carrier := propagation.MapCarrier{}
+	for _, field := range fields[1:] {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			carrier.Set(k, v)
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier), fields[0]
+}
+
+// parseError parses a protocol error line sent by the server
+func parseError(line string) *ProtocolError {
+	details := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, errorPrefix)), "\t")
+	fields := strings.SplitN(details[0], " ", 2)
+	e := &ProtocolError{Status: fields[0]}
+	if len(fields) > 1 {
+		e.Message = fields[1]
+	}
+	for _, detail := range details[1:] {
+		if k, v, ok := strings.Cut(detail, "="); ok {
+			if e.Details == nil {
+				e.Details = map[string]string{}
+			}
+			e.Details[k] = v
+		}
+	}
+	return e
+}
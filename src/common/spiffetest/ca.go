@@ -0,0 +1,185 @@
+// Package spiffetest provides an in-memory CA, a fake Workload API and the
+// helpers shared by the tests of the services, to test them without SPIRE.
+package spiffetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// DefaultSVIDTTL is the lifetime of the X509-SVIDs minted by a CA
+const DefaultSVIDTTL = time.Hour
+
+// jwtKeyID identifies the key of the CA in the JWT bundle
+const jwtKeyID = "spiffetest"
+
+// CA is the in-memory root CA of a trust domain minting X509-SVIDs
+type CA struct {
+	tb          testing.TB
+	trustDomain spiffeid.TrustDomain
+	cert        *x509.Certificate
+	key         crypto.Signer
+
+	mu     sync.Mutex
+	serial int64
+}
+
+// NewCA creates the CA of a trust domain, e.g. domain.test
+func NewCA(tb testing.TB, trustDomain string) *CA {
+	tb.Helper()
+
+	td, err := spiffeid.TrustDomainFromString(trustDomain)
+	if err != nil {
+		tb.Fatalf("invalid trust domain %q: %v", trustDomain, err)
+	}
+
+	key := newKey(tb)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: td.String() + " CA"},
+		URIs:                  []*url.URL{td.ID().URL()},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		tb.Fatalf("unable to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("unable to parse CA certificate: %v", err)
+	}
+	return &CA{tb: tb, trustDomain: td, cert: cert, key: key, serial: 1}
+}
+
+// TrustDomain returns the trust domain of the CA
+func (ca *CA) TrustDomain() spiffeid.TrustDomain {
+	return ca.trustDomain
+}
+
+// Bundle returns the X509 bundle of the trust domain
+func (ca *CA) Bundle() *x509bundle.Bundle {
+	return x509bundle.FromX509Roots(ca.trustDomain, []*x509.Certificate{ca.cert})
+}
+
+// JWTBundle returns the JWT bundle of the trust domain, holding the key signing
+// the JWT-SVIDs minted by MintJWTSVID
+func (ca *CA) JWTBundle() *jwtbundle.Bundle {
+	return jwtbundle.FromJWTKeys(ca.trustDomain, map[string]crypto.PublicKey{jwtKeyID: ca.key.Public()})
+}
+
+// MintJWTSVID mints a JWT-SVID for a SPIFFE ID issued for audience and valid
+// for ttl. A negative ttl gives an expired token.
+func (ca *CA) MintJWTSVID(spiffeID string, audience []string, ttl time.Duration) string {
+	ca.tb.Helper()
+
+	if _, err := spiffeid.FromString(spiffeID); err != nil {
+		ca.tb.Fatalf("invalid SPIFFE ID %q: %v", spiffeID, err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.ES256,
+		Key:       jose.JSONWebKey{Key: ca.key, KeyID: jwtKeyID},
+	}, new(jose.SignerOptions).WithType("JWT"))
+	if err != nil {
+		ca.tb.Fatalf("unable to create JWT signer: %v", err)
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  spiffeID,
+		Audience: audience,
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(time.Now().Add(ttl)),
+	}).CompactSerialize()
+	if err != nil {
+		ca.tb.Fatalf("unable to sign JWT-SVID: %v", err)
+	}
+	return token
+}
+
+// MintX509SVID mints an X509-SVID for a SPIFFE ID, e.g.
+// spiffe://domain.test/privileged, valid for ttl
+func (ca *CA) MintX509SVID(spiffeID string, ttl time.Duration) *x509svid.SVID {
+	ca.tb.Helper()
+
+	id, err := spiffeid.FromString(spiffeID)
+	if err != nil {
+		ca.tb.Fatalf("invalid SPIFFE ID %q: %v", spiffeID, err)
+	}
+
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	key := newKey(ca.tb)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		URIs:         []*url.URL{id.URL()},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		ca.tb.Fatalf("unable to create X509-SVID: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		ca.tb.Fatalf("unable to parse X509-SVID: %v", err)
+	}
+	return &x509svid.SVID{ID: id, Certificates: []*x509.Certificate{cert}, PrivateKey: key}
+}
+
+// WriteX509SVID mints an X509-SVID and writes it to dir as PEM files, e.g.
+// for common.NewStaticX509Source. It returns the paths of the certificate,
+// the key and the bundle.
+func (ca *CA) WriteX509SVID(dir, spiffeID string) (certFile, keyFile, bundleFile string) {
+	ca.tb.Helper()
+
+	certPEM, keyPEM, err := ca.MintX509SVID(spiffeID, DefaultSVIDTTL).Marshal()
+	if err != nil {
+		ca.tb.Fatalf("unable to marshal X509-SVID: %v", err)
+	}
+	bundlePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+
+	certFile = filepath.Join(dir, "svid.pem")
+	keyFile = filepath.Join(dir, "svid-key.pem")
+	bundleFile = filepath.Join(dir, "bundle.pem")
+	for path, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM, bundleFile: bundlePEM} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			ca.tb.Fatalf("unable to write %s: %v", path, err)
+		}
+	}
+	return certFile, keyFile, bundleFile
+}
+
+func newKey(tb testing.TB) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatalf("unable to generate key: %v", err)
+	}
+	return key
+}
@@ -0,0 +1,50 @@
+package spiffetest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// X509Source is an X509 source holding a single SVID and a bundle, e.g. to
+// configure a dialer or a listener without a Workload API
+type X509Source struct {
+	*x509svid.SVID
+	*x509bundle.Bundle
+}
+
+// X509Source returns a source holding a new SVID of the CA valid for
+// DefaultSVIDTTL and the bundle of its trust domain
+func (ca *CA) X509Source(spiffeID string) X509Source {
+	return X509Source{SVID: ca.MintX509SVID(spiffeID, DefaultSVIDTTL), Bundle: ca.Bundle()}
+}
+
+// Chdir changes the working directory until the end of the test, e.g. to the
+// directory the policy of a service is read from
+func Chdir(tb testing.TB, dir string) {
+	tb.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.Chdir(wd) })
+}
+
+// WaitFor polls cond until it holds, e.g. for an update pushed by the
+// Workload API. The test fails if it does not hold within 10s.
+func WaitFor(tb testing.TB, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal("condition not met after 10s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
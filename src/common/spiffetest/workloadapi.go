@@ -0,0 +1,184 @@
+package spiffetest
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// WorkloadAPI is a fake Workload API served on a unix socket, issuing the
+// X509-SVIDs of a workload minted by a CA. It is stopped at the end of the test.
+type WorkloadAPI struct {
+	tb     testing.TB
+	ca     *CA
+	addr   string
+	server *grpc.Server
+
+	mu        sync.Mutex
+	ids       []string
+	ttl       time.Duration
+	federated []*CA
+	resp      *workload.X509SVIDResponse
+	// changed is closed and replaced whenever resp is updated
+	changed chan struct{}
+}
+
+// NewWorkloadAPI starts a Workload API issuing X509-SVIDs for the SPIFFE IDs,
+// e.g. spiffe://domain.test/privileged, the first one being the default SVID
+func NewWorkloadAPI(tb testing.TB, ca *CA, ids ...string) *WorkloadAPI {
+	tb.Helper()
+
+	// Unix socket paths are limited to about 100 bytes, those of tb.TempDir are too long
+	dir, err := os.MkdirTemp("", "spiffetest")
+	if err != nil {
+		tb.Fatalf("unable to create socket directory: %v", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		tb.Fatalf("unable to listen on %s: %v", path, err)
+	}
+
+	w := &WorkloadAPI{
+		tb:      tb,
+		ca:      ca,
+		addr:    "unix://" + path,
+		server:  grpc.NewServer(),
+		ttl:     DefaultSVIDTTL,
+		changed: make(chan struct{}),
+	}
+	w.SetIDs(ids...)
+	workload.RegisterSpiffeWorkloadAPIServer(w.server, w)
+
+	go w.server.Serve(listener)
+	tb.Cleanup(w.server.Stop)
+	return w
+}
+
+// Addr returns the address of the Workload API, e.g. for common.WithSocketPath
+func (w *WorkloadAPI) Addr() string {
+	return w.addr
+}
+
+// SetIDs changes the SPIFFE IDs of the workload, SVIDs are minted and pushed to the watchers
+func (w *WorkloadAPI) SetIDs(ids ...string) {
+	w.tb.Helper()
+	w.mu.Lock()
+	w.ids = ids
+	w.mu.Unlock()
+	w.Rotate()
+}
+
+// SetTTL sets the lifetime of the SVIDs minted from now on, e.g. to test expiry
+func (w *WorkloadAPI) SetTTL(ttl time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ttl = ttl
+}
+
+// Federate adds the bundle of the trust domain of ca to the federated bundles
+func (w *WorkloadAPI) Federate(ca *CA) {
+	w.tb.Helper()
+	w.mu.Lock()
+	w.federated = append(w.federated, ca)
+	w.mu.Unlock()
+	w.Rotate()
+}
+
+// Rotate mints new SVIDs for the SPIFFE IDs and pushes them to the watchers
+func (w *WorkloadAPI) Rotate() {
+	w.tb.Helper()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	resp := &workload.X509SVIDResponse{FederatedBundles: map[string][]byte{}}
+	for _, id := range w.ids {
+		svid := w.ca.MintX509SVID(id, w.ttl)
+		key, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+		if err != nil {
+			w.tb.Fatalf("unable to marshal X509-SVID key: %v", err)
+		}
+		resp.Svids = append(resp.Svids, &workload.X509SVID{
+			SpiffeId:    svid.ID.String(),
+			X509Svid:    concatRaw(svid.Certificates),
+			X509SvidKey: key,
+			Bundle:      concatRaw(w.ca.Bundle().X509Roots()),
+		})
+	}
+	for _, ca := range w.federated {
+		resp.FederatedBundles[ca.TrustDomain().IDString()] = concatRaw(ca.Bundle().X509Roots())
+	}
+
+	w.resp = resp
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// FetchX509SVID streams the X509-SVIDs, sending them again whenever they change
+func (w *WorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	if err := checkHeader(stream.Context()); err != nil {
+		return err
+	}
+	for {
+		w.mu.Lock()
+		resp, changed := w.resp, w.changed
+		w.mu.Unlock()
+
+		if len(resp.Svids) == 0 {
+			return status.Error(codes.PermissionDenied, "no identity issued")
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// FetchJWTSVID is not supported
+func (w *WorkloadAPI) FetchJWTSVID(context.Context, *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "JWT-SVIDs are not supported")
+}
+
+// FetchJWTBundles is not supported
+func (w *WorkloadAPI) FetchJWTBundles(*workload.JWTBundlesRequest, workload.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
+	return status.Error(codes.Unimplemented, "JWT bundles are not supported")
+}
+
+// ValidateJWTSVID is not supported
+func (w *WorkloadAPI) ValidateJWTSVID(context.Context, *workload.ValidateJWTSVIDRequest) (*workload.ValidateJWTSVIDResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "JWT-SVIDs are not supported")
+}
+
+// checkHeader rejects the requests without the security header, like SPIRE
+func checkHeader(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("workload.spiffe.io")) != 1 || md.Get("workload.spiffe.io")[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	return nil
+}
+
+func concatRaw(certs []*x509.Certificate) []byte {
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	return raw
+}
@@ -0,0 +1,73 @@
+package spiffetest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+func TestWorkloadAPIRotation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	api := spiffetest.NewWorkloadAPI(t, ca, "spiffe://domain.test/privileged")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	source, err := common.NewX509Source(ctx, common.WithSocketPath(api.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	first := currentSVID(t, source)
+	if got := first.ID.String(); got != "spiffe://domain.test/privileged" {
+		t.Fatalf("got SPIFFE ID %s, want spiffe://domain.test/privileged", got)
+	}
+	if _, _, err := x509svid.Verify(first.Certificates, source); err != nil {
+		t.Fatalf("SVID not verified by the bundle: %v", err)
+	}
+
+	api.Rotate()
+	spiffetest.WaitFor(t, func() bool {
+		return currentSVID(t, source).Certificates[0].SerialNumber.Cmp(first.Certificates[0].SerialNumber) != 0
+	})
+
+	api.SetIDs("spiffe://domain.test/external")
+	spiffetest.WaitFor(t, func() bool {
+		return currentSVID(t, source).ID.String() == "spiffe://domain.test/external"
+	})
+}
+
+func TestWorkloadAPIFederation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	partner := spiffetest.NewCA(t, "partner.test")
+	api := spiffetest.NewWorkloadAPI(t, ca, "spiffe://domain.test/db-server")
+	api.Federate(partner)
+
+	source, err := common.NewX509Source(context.Background(), common.WithSocketPath(api.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	svid := partner.MintX509SVID("spiffe://partner.test/app", time.Hour)
+	if _, _, err := x509svid.Verify(svid.Certificates, source); err != nil {
+		t.Fatalf("partner SVID not verified by the federated bundle: %v", err)
+	}
+	if _, err := source.GetX509BundleForTrustDomain(spiffeid.RequireTrustDomainFromString("partner.test")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func currentSVID(t *testing.T, source x509svid.Source) *x509svid.SVID {
+	t.Helper()
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svid
+}
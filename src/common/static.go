@@ -0,0 +1,168 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// staticPollInterval is how often the files of a StaticX509Source are checked for changes
+const staticPollInterval = time.Second
+
+// ClosableX509Source is an X509Source holding resources, e.g. a Workload API
+// connection or a file watcher, released by Close
+type ClosableX509Source interface {
+	X509Source
+	Close() error
+}
+
+// StaticX509Source provides an X509-SVID and the bundle of its trust domain
+// loaded from PEM files instead of the Workload API, e.g. to run the services
+// without SPIRE in development and CI. The files are reloaded when they
+// change so that rotated SVIDs are picked up.
+type StaticX509Source struct {
+	certFile, keyFile, bundleFile string
+
+	mu      sync.RWMutex
+	svid    *x509svid.SVID
+	bundle  *x509bundle.Bundle
+	modTime time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewStaticX509Source loads the X509-SVID from certFile (the leaf first, then
+// the intermediates) and keyFile, and the CA certificates of its trust domain
+// from bundleFile. It must be closed by the caller.
+func NewStaticX509Source(ctx context.Context, certFile, keyFile, bundleFile string) (*StaticX509Source, error) {
+	s := &StaticX509Source{certFile: certFile, keyFile: keyFile, bundleFile: bundleFile}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go s.watch(ctx)
+	return s, nil
+}
+
+// GetX509SVID returns the current X509-SVID
+func (s *StaticX509Source) GetX509SVID() (*x509svid.SVID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.svid, nil
+}
+
+// GetX509BundleForTrustDomain returns the bundle of the trust domain of the SVID
+func (s *StaticX509Source) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if td != s.bundle.TrustDomain() {
+		return nil, fmt.Errorf("no bundle for trust domain %q", td)
+	}
+	return s.bundle, nil
+}
+
+// Close stops watching the files
+func (s *StaticX509Source) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// load reads the files, keeping the previous SVID and bundle on error
+func (s *StaticX509Source) load() error {
+	modTime, err := s.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	svid, err := x509svid.Load(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load X509-SVID: %v", err)
+	}
+	bundle, err := x509bundle.Load(svid.ID.TrustDomain(), s.bundleFile)
+	if err != nil {
+		return fmt.Errorf("unable to load X509 bundle: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.svid, s.bundle, s.modTime = svid, bundle, modTime
+	return nil
+}
+
+// watch reloads the files whenever one of them is modified until ctx is done
+func (s *StaticX509Source) watch(ctx context.Context) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(staticPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := s.latestModTime()
+		s.mu.RLock()
+		changed := err == nil && !modTime.Equal(s.modTime)
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		// The cert and key may be written one after the other, a mismatch is retried on the next tick
+		if err := s.load(); err != nil {
+			slog.Warn("unable to reload SVID files", "cert", s.certFile, "error", err)
+			continue
+		}
+		svid, _ := s.GetX509SVID()
+		slog.Info("reloaded SVID files", "spiffe_id", svid.ID.String(), "svid_expiry", svid.Certificates[0].NotAfter)
+	}
+}
+
+// latestModTime returns the modification time of the most recently modified file
+func (s *StaticX509Source) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{s.certFile, s.keyFile, s.bundleFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unable to stat %s: %v", path, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// NewX509SourceFromFlags creates a StaticX509Source if certFile is set, and a
+// Workload API source otherwise. keyFile and bundleFile are then required.
+func NewX509SourceFromFlags(ctx context.Context, certFile, keyFile, bundleFile string, opts ...Option) (ClosableX509Source, error) {
+	if certFile == "" {
+		source, err := NewX509Source(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	}
+	if keyFile == "" || bundleFile == "" {
+		return nil, errors.New("the SVID key and bundle files are required along with the SVID certificate file")
+	}
+	source, err := NewStaticX509Source(ctx, certFile, keyFile, bundleFile)
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// touch moves the modification time of the files forward so that a rewrite
+// within the resolution of the file system is noticed
+func touch(t *testing.T, paths ...string) {
+	t.Helper()
+	later := time.Now().Add(time.Minute)
+	for _, path := range paths {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStaticX509SourceReload(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	dir := t.TempDir()
+	certFile, keyFile, bundleFile := ca.WriteX509SVID(dir, "spiffe://domain.test/privileged")
+
+	source, err := NewStaticX509Source(context.Background(), certFile, keyFile, bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	svid, _ := source.GetX509SVID()
+	if got := svid.ID.String(); got != "spiffe://domain.test/privileged" {
+		t.Errorf("got SVID %s, want spiffe://domain.test/privileged", got)
+	}
+	if bundle, err := source.GetX509BundleForTrustDomain(ca.TrustDomain()); err != nil || !sameRoots(bundle, ca.Bundle()) {
+		t.Errorf("got %v, %v, want the bundle of the CA", bundle, err)
+	}
+	if _, err := source.GetX509BundleForTrustDomain(spiffeid.RequireTrustDomainFromString("partner.test")); err == nil {
+		t.Error("got a bundle for another trust domain")
+	}
+
+	// A certificate being written is ignored, the previous SVID is kept
+	if err := os.WriteFile(certFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, certFile)
+	time.Sleep(staticPollInterval + 500*time.Millisecond)
+	if current, _ := source.GetX509SVID(); current != svid {
+		t.Error("SVID replaced by an invalid certificate file")
+	}
+
+	// The rotated SVID is picked up
+	ca.WriteX509SVID(dir, "spiffe://domain.test/restricted")
+	touch(t, certFile, keyFile, bundleFile)
+	spiffetest.WaitFor(t, func() bool {
+		current, _ := source.GetX509SVID()
+		return current.ID.String() == "spiffe://domain.test/restricted"
+	})
+}
+
+// TestStaticX509SourceDial authenticates with SVIDs loaded from files, which
+// spiffetls would not do without a Workload API
+func TestStaticX509SourceDial(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	certFile, keyFile, bundleFile := ca.WriteX509SVID(t.TempDir(), "spiffe://domain.test/privileged")
+	source, err := NewX509SourceFromFlags(context.Background(), certFile, keyFile, bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	addr := startHelloServer(t,
+		WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()))
+
+	ctx := context.Background()
+	conn, err := CreateTLSDialer(ctx, addr, WithX509Source(source), WithAuthorizer(tlsconfig.AuthorizeAny()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteCommand(ctx, conn, "Hello server"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadData(ctx, conn, ""); err != nil || got != "Hello spiffe://domain.test/privileged\n" {
+		t.Errorf("got %q, %v, want the server to greet the SVID of the files", got, err)
+	}
+}
+
+func TestNewX509SourceFromFlagsErrors(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	certFile, keyFile, bundleFile := ca.WriteX509SVID(t.TempDir(), "spiffe://domain.test/privileged")
+	_, otherKeyFile, _ := ca.WriteX509SVID(t.TempDir(), "spiffe://domain.test/privileged")
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name                          string
+		certFile, keyFile, bundleFile string
+	}{
+		{"without key", certFile, "", bundleFile},
+		{"without bundle", certFile, keyFile, ""},
+		{"missing certificate", missing, keyFile, bundleFile},
+		{"missing bundle", certFile, keyFile, missing},
+		{"key of another SVID", certFile, otherKeyFile, bundleFile},
+		{"invalid certificate", writeFile(t, "svid.pem", "not pem"), keyFile, bundleFile},
+	}
+	for _, tt := range tests {
+		source, err := NewX509SourceFromFlags(context.Background(), tt.certFile, tt.keyFile, tt.bundleFile)
+		if err == nil {
+			source.Close()
+			t.Errorf("%s: got no error", tt.name)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // Patient holds patient info
 type Patient struct {
 	ID           string `json:"id,omitempty"`
@@ -11,8 +13,10 @@ type Patient struct {
 
 // Result holds the final response to return to the client
 type Result struct {
-	Client           string    `json:"client,omitempty"`
-	ConnectionStatus string    `json:"connection_status,omitempty"`
-	Reason           string    `json:"reason,omitempty"`
-	Patients         []Patient `json:"patients,omitempty"`
+	Client           string     `json:"client,omitempty"`
+	TrustDomain      string     `json:"trust_domain,omitempty"`
+	SVIDExpiry       *time.Time `json:"svid_expiry,omitempty"`
+	ConnectionStatus string     `json:"connection_status,omitempty"`
+	Reason           string     `json:"reason,omitempty"`
+	Patients         []Patient  `json:"patients,omitempty"`
 }
@@ -2,95 +2,236 @@ package common
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/opa-spiffe-demo/src/opa"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
-	"github.com/spiffe/go-spiffe/v2/spiffetls"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"log"
+	"log/slog"
 	"net"
-	"os"
+	"strings"
 	"time"
 )
 
 const (
-	spiffeSocketPath = "unix:///tmp/agent.sock"
-	dialTimeout      = 2 * time.Minute
+	dialTimeout = 2 * time.Minute
 )
 
-// CreateTLSDialer creates a mTLS connection
-func CreateTLSDialer(serverAddress string) net.Conn {
+// CreateTLSDialer creates a mTLS connection. It returns a *WorkloadAPIError if
+// the SVID cannot be fetched, an *AuthorizationError if a policy denies the
+// connection, a *TrustError if a SVID cannot be verified and a *HandshakeError
+// if the connection cannot be established.
+func CreateTLSDialer(ctx context.Context, serverAddress string, opts ...Option) (net.Conn, error) {
+	ctx, span := tracer.Start(ctx, "common.CreateTLSDialer", trace.WithAttributes(attribute.String("net.peer.name", serverAddress)))
+	defer span.End()
 
-	// Set SPIFFE_ENDPOINT_SOCKET to the workload API provider socket path (SPIRE is used in this example).
-	err := os.Setenv("SPIFFE_ENDPOINT_SOCKET", spiffeSocketPath)
-	if err != nil {
-		log.Fatalf("Unable to set SPIFFE_ENDPOINT_SOCKET env variable: %v", err)
-	}
+	o := newOptions(opts)
 
 	//Setup context
-	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
 	defer cancel()
 
-	// Create a TLS connection with OPA as authorizer
-	conn, err := spiffetls.Dial(ctx, "tcp", serverAddress, Authorizer())
+	// Fetch the X509-SVID and bundles from the Workload API unless a long-lived source is shared
+	source := o.source
+	var closer io.Closer
+	if source == nil {
+		_, fetchSpan := tracer.Start(ctx, "workloadapi.NewX509Source")
+		s, err := NewX509Source(ctx, opts...)
+		fetchSpan.End()
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		source, closer = o.withFederated(s), s
+	}
+
+	// Create a TLS connection with OPA as authorizer. The handshake error does
+	// not tell a denial or an untrusted server SVID apart from other failures,
+	// the authorizer remembers the denial and the failed verifications of the
+	// SVID are wrapped in a *TrustError.
+	hsCtx, hsSpan := tracer.Start(ctx, "tls.Handshake")
+	var verified bool
+	var denied *AuthorizationError
+	authorizer := func(id spiffeid.ID, chains [][]*x509.Certificate) error {
+		verified = true
+		err := o.authorizerFor(hsCtx, opa.RoleClient, source)(id, chains)
+		if err != nil {
+			denied = &AuthorizationError{PeerID: id.String(), Err: err}
+			var derr *opa.DeniedError
+			if errors.As(err, &derr) {
+				denied.DecisionID, denied.Rule, denied.Reasons = derr.DecisionID, derr.Rule, derr.Reasons
+			}
+		}
+		return err
+	}
+	start := time.Now()
+	// spiffetls only dials with a *workloadapi.X509Source, its WithConfig modes
+	// creating one too, so crypto/tls is used with any X509Source, e.g. a
+	// StaticX509Source. The listener does the same.
+	config := tlsconfig.MTLSClientConfig(source, source, authorizer)
+	verify := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+		err := verify(raw, chains)
+		if err != nil && !verified {
+			return &TrustError{Err: err}
+		}
+		return err
+	}
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(hsCtx, "tcp", serverAddress)
+	observeHandshake(roleClient, start, err)
+	hsSpan.End()
 	if err != nil {
-		log.Fatalf("Unable to create TLS connection: %v", err)
+		if closer != nil {
+			closer.Close()
+		}
+		span.SetStatus(codes.Error, err.Error())
+		clientID := ""
+		if svid, err := source.GetX509SVID(); err == nil {
+			clientID = svid.ID.String()
+		}
+		return nil, dialError(err, serverAddress, clientID, denied)
 	}
-	return conn
+
+	tracked := newTrackedConn(conn, roleClient)
+	tracked.closer = closer
+	return tracked, nil
 }
 
-func CreateTLSLIstener(ctx context.Context, serverAddress string) net.Listener {
+// CreateTLSLIstener creates a mTLS listener authorizing clients with OPA. It
+// returns a *WorkloadAPIError if the SVID cannot be fetched.
+func CreateTLSLIstener(ctx context.Context, serverAddress string, opts ...Option) (net.Listener, error) {
 
-	// Set SPIFFE_ENDPOINT_SOCKET to the workload API provider socket path (SPIRE is used in this example).
-	err := os.Setenv("SPIFFE_ENDPOINT_SOCKET", spiffeSocketPath)
-	if err != nil {
-		log.Fatalf("Unable to set SPIFFE_ENDPOINT_SOCKET env variable: %v", err)
+	o := newOptions(opts)
+
+	// Fetch the X509-SVID and bundles from the Workload API unless a long-lived
+	// source is shared, the source then lives as long as the listener
+	source := o.source
+	var closer io.Closer
+	if source == nil {
+		s, err := NewX509Source(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		source, closer = o.withFederated(s), s
 	}
 
-	// Creates a TLS listener with OPA as authorizer
-	listener, err := spiffetls.Listen(ctx, "tcp", serverAddress, Authorizer())
+	// Creates a TLS listener with OPA as authorizer, peers outside of the
+	// trust domain of our SVID being federated
+	inner, err := net.Listen("tcp", serverAddress)
 	if err != nil {
-		log.Fatalf("Unable to create TLS listener: %v", err)
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("unable to create TLS listener: %v", err)
+	}
+	config := tlsconfig.MTLSServerConfig(source, source, o.authorizerFor(ctx, opa.RoleServer, source))
+	return trackedListener{Listener: tls.NewListener(inner, config), closer: closer}, nil
+}
+
+// dialError classifies a failed dial. Errors other than a denial, a TLS alert
+// of the server or a failed verification of the server SVID, e.g. a timeout or
+// a connection closed during the handshake, are handshake failures.
+func dialError(err error, serverAddress, clientID string, denied *AuthorizationError) error {
+	if denied != nil {
+		return denied
+	}
+	if rerr := remoteAlertError(err, clientID); rerr != nil {
+		return rerr
+	}
+	var terr *TrustError
+	if errors.As(err, &terr) {
+		return terr
 	}
-	return listener
+	return &HandshakeError{Address: serverAddress, Err: err}
 }
 
-// Authorizer authorizes the request using OPA
-func Authorizer() tlsconfig.Authorizer {
+// Authorizer authorizes the request using OPA with the rules of the role, i.e.
+// opa.RoleClient when dialing and opa.RoleServer when listening. Peers outside
+// of localTrustDomain are reported to the policy as federated. Policy
+// evaluations are traced as part of ctx.
+func Authorizer(ctx context.Context, role opa.Role, localTrustDomain string) tlsconfig.Authorizer {
 	return tlsconfig.Authorizer(func(actual spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
-		return opa.Authorizer(actual.String(), verifiedChains)
+		return opa.Authorizer(ctx, role, actual.String(), localTrustDomain, verifiedChains)
 	})
 }
 
-// ReadData reads server response
-func ReadData(conn net.Conn, clientSpiffeID string) (string, error) {
+// ReadData reads server response. It returns an *AuthorizationError if the
+// server denied the client, a *ProtocolError for other errors reported by the
+// server and an *IOError if the response cannot be read.
+func ReadData(ctx context.Context, conn net.Conn, clientSpiffeID string) (string, error) {
 
 	// Read server response
 	status, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil && err != io.EOF && err.Error() == "remote error: tls: bad certificate" {
-		log.Printf("DB Server says => OPA denied request: unexpected peer ID %v\n\n", clientSpiffeID)
-		return "", fmt.Errorf("OPA denied request: unexpected peer ID %v\n\n", clientSpiffeID)
+	if err != nil && (err != io.EOF || status == "") {
+		return "", readError(ctx, err, clientSpiffeID)
+	}
+	if strings.HasPrefix(status, errorPrefix) {
+		return "", serverError(ctx, parseError(status), clientSpiffeID)
 	}
 	return status, nil
 }
 
-// ReadDataJSON reads server response
-func ReadDataJSON(conn net.Conn, clientSpiffeID string) ([]Patient, error) {
+// ReadDataJSON reads server response. Errors are those of ReadData.
+func ReadDataJSON(ctx context.Context, conn net.Conn, clientSpiffeID string) ([]Patient, error) {
+
+	// Read the whole line so that a pooled connection is left at the next response
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, readError(ctx, err, clientSpiffeID)
+	}
+	if bytes.HasPrefix(line, []byte(errorPrefix)) {
+		return nil, serverError(ctx, parseError(string(line)), clientSpiffeID)
+	}
 
-	// Read server response
-	decoder := json.NewDecoder(conn)
 	patients := []Patient{}
+	if err := json.Unmarshal(line, &patients); err != nil {
+		slog.ErrorContext(ctx, "Decoding error", "error", err)
+		return nil, fmt.Errorf("unable to decode patients: %v", err)
+	}
+	return patients, nil
+}
+
+// readError converts an error reading the response. With TLS 1.3, the server
+// verifies the client SVID after the client completed the handshake, so a
+// rejection is only seen as an alert on the first read.
+func readError(ctx context.Context, err error, clientSpiffeID string) error {
+	if rerr := remoteAlertError(err, clientSpiffeID); rerr != nil {
+		slog.WarnContext(ctx, "DB Server rejected the connection", "peer_id", clientSpiffeID, "error", rerr)
+		return rerr
+	}
+	slog.ErrorContext(ctx, "Unable to read response", "error", err)
+	return &IOError{Op: "read response", Err: err}
+}
 
-	if err := decoder.Decode(&patients); err != nil {
-		if err.Error() == "remote error: tls: bad certificate" {
-			log.Printf("DB Server says => OPA denied request: unexpected peer ID %v\n\n", clientSpiffeID)
-			return nil, fmt.Errorf("OPA denied request: unexpected peer ID %v\n\n", clientSpiffeID)
+// serverError converts a protocol error sent by the server
+func serverError(ctx context.Context, perr *ProtocolError, clientSpiffeID string) error {
+	if perr.Status != StatusDenied {
+		slog.WarnContext(ctx, "DB Server returned an error", "status", perr.Status, "message", perr.Message)
+		return perr
+	}
+
+	aerr := &AuthorizationError{
+		PeerID:     clientSpiffeID,
+		Remote:     true,
+		DecisionID: perr.Details["decision_id"],
+		Rule:       perr.Details["rule"],
+		Err:        errors.New(perr.Message),
+	}
+	if reasons := perr.Details["reasons"]; reasons != "" {
+		if err := json.Unmarshal([]byte(reasons), &aerr.Reasons); err != nil {
+			slog.WarnContext(ctx, "Invalid deny reasons", "reasons", reasons, "error", err)
 		}
-		log.Printf("Dencoding error: %v\n", err)
 	}
-	return patients, nil
+	slog.WarnContext(ctx, "DB Server says => OPA denied request", "peer_id", clientSpiffeID, "decision_id", aerr.DecisionID, "rule", aerr.Rule)
+	return aerr
 }
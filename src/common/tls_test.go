@@ -0,0 +1,119 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// The benchmarks dial an in-process server answering "Hello server" like the
+// db server, the client SVID coming from a fake Workload API, e.g.
+//
+//	go test -run - -bench Dial
+//
+// Peers are authorized with tlsconfig.AuthorizeAny so that only the cost of
+// fetching the SVID and of the handshake is measured.
+
+// startHelloServer serves mTLS connections with the given options until the
+// end of the test and returns its address. It answers each line with
+// "Hello <peer ID>" like the db server.
+func startHelloServer(tb testing.TB, opts ...Option) string {
+	tb.Helper()
+	return startTLSServer(tb, serveHello, opts...)
+}
+
+// startTLSServer serves mTLS connections with handle until the end of the
+// test and returns its address
+func startTLSServer(tb testing.TB, handle func(net.Conn), opts ...Option) string {
+	tb.Helper()
+
+	listener, err := CreateTLSLIstener(context.Background(), "127.0.0.1:0", opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveHello(conn net.Conn) {
+	defer conn.Close()
+	if err := Handshake(conn); err != nil {
+		return
+	}
+	id, err := spiffetls.PeerIDFromConn(conn)
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(conn)
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(conn, "Hello %v\n", id); err != nil {
+			return
+		}
+	}
+}
+
+func benchmarkDial(b *testing.B, addr string, opts ...Option) {
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		conn, err := CreateTLSDialer(ctx, addr, opts...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := WriteCommand(ctx, conn, "Hello server"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ReadData(ctx, conn, ""); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+// newBenchmarkSetup starts the server and the Workload API of the client
+func newBenchmarkSetup(b *testing.B) (addr string, api *spiffetest.WorkloadAPI) {
+	ca := spiffetest.NewCA(b, "domain.test")
+	addr = startHelloServer(b,
+		WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		WithAuthorizer(tlsconfig.AuthorizeAny()))
+	return addr, spiffetest.NewWorkloadAPI(b, ca, "spiffe://domain.test/privileged")
+}
+
+// BenchmarkDialNewSource fetches the SVID from the Workload API on every dial
+func BenchmarkDialNewSource(b *testing.B) {
+	addr, api := newBenchmarkSetup(b)
+
+	b.ResetTimer()
+	benchmarkDial(b, addr, WithSocketPath(api.Addr()), WithAuthorizer(tlsconfig.AuthorizeAny()))
+}
+
+// BenchmarkDialSharedSource reuses a single source across dials
+func BenchmarkDialSharedSource(b *testing.B) {
+	addr, api := newBenchmarkSetup(b)
+	source, err := NewX509Source(context.Background(), WithSocketPath(api.Addr()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer source.Close()
+
+	b.ResetTimer()
+	benchmarkDial(b, addr, WithX509Source(source), WithAuthorizer(tlsconfig.AuthorizeAny()))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/opa-spiffe-demo/src/opa"
+)
+
+// The end-to-end tests run the db server and the client of each workload
+// in-process, with the clock of the policy pinned, each workload getting its
+// SVID from a fake Workload API. The clients pool their connections like the
+// client binary does by default. They are skipped with -short.
+
+// week is the first week of 2024, at noon UTC, from Monday to Sunday
+var week = func() []time.Time {
+	days := make([]time.Time, 7)
+	for i := range days {
+		days[i] = time.Date(2024, time.January, 1+i, 12, 0, 0, 0, time.UTC)
+	}
+	return days
+}()
+
+var (
+	monday  = week[0]
+	tuesday = week[1]
+)
+
+// decisionIDPattern matches the random decision ID in the reasons
+var decisionIDPattern = regexp.MustCompile(`decision [0-9a-f]+\)`)
+
+func allPatients() []common.Patient {
+	return generateTestData()
+}
+
+func maskedPatients() []common.Patient {
+	patients := generateTestData()
+	for i := range patients {
+		patients[i].SSN = "***********"
+		patients[i].EnrolleeType = "***********"
+	}
+	return patients
+}
+
+type e2eTest struct {
+	workload string
+	day      time.Time
+	path     string
+	status   int
+	want     common.Result
+}
+
+// e2eTests are the results of each workload on each day of the week, external
+// being blocked on Mondays, Wednesdays and Fridays
+func e2eTests() []e2eTest {
+	var tests []e2eTest
+	for _, day := range week {
+		tests = append(tests,
+			e2eTest{"privileged", day, "/getdata", http.StatusOK, common.Result{Patients: allPatients()}},
+			e2eTest{"restricted", day, "/getdata", http.StatusOK, common.Result{Patients: maskedPatients()}},
+		)
+
+		switch day.Weekday() {
+		case time.Monday, time.Wednesday, time.Friday:
+			reason := fmt.Sprintf("DB Server says => OPA denied request: external is blocked on %vs (rule data.example.allow, decision *)", day.Weekday())
+			tests = append(tests,
+				e2eTest{"external", day, "/getdata", http.StatusForbidden, common.Result{Reason: reason}},
+				e2eTest{"external", day, "/connect", http.StatusForbidden, common.Result{ConnectionStatus: "Not Created", Reason: reason}},
+			)
+		default:
+			tests = append(tests,
+				e2eTest{"external", day, "/getdata", http.StatusOK, common.Result{Patients: allPatients()}},
+				e2eTest{"external", day, "/connect", http.StatusOK, common.Result{
+					ConnectionStatus: "Created",
+					Reason:           "OPA allowed request: Hello spiffe://domain.test/external",
+				}},
+			)
+		}
+	}
+	return tests
+}
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("end-to-end test skipped with -short")
+	}
+
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rate limits of external allow a few commands per day, let the
+	// buckets refill between the days as they would in a real week
+	var elapsed atomic.Int64
+	limiterClock := func() time.Time { return time.Now().Add(time.Duration(elapsed.Load())) }
+
+	ca := spiffetest.NewCA(t, "domain.test")
+	dbAddr := startDBServer(t, root, ca, limiterClock)
+	clients := map[string]string{}
+	for _, name := range []string{"privileged", "restricted", "external"} {
+		clients[name] = startClient(t, root, ca, name, dbAddr)
+	}
+
+	for _, tt := range e2eTests() {
+		t.Run(tt.workload+tt.path+"/"+tt.day.Weekday().String(), func(t *testing.T) {
+			opa.SetClock(func() time.Time { return tt.day })
+			t.Cleanup(func() { opa.SetClock(time.Now) })
+			elapsed.Store(int64(tt.day.Sub(monday)))
+
+			resp, err := http.Get(clients[tt.workload] + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var got common.Result
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("unable to decode result: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			// The SVID expiry and the decision ID change on every run
+			if got.SVIDExpiry == nil {
+				t.Error("got no SVID expiry")
+			}
+			got.SVIDExpiry = nil
+			got.Reason = decisionIDPattern.ReplaceAllString(got.Reason, "decision *)")
+
+			tt.want.Client = "spiffe://domain.test/" + tt.workload
+			tt.want.TrustDomain = "domain.test"
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got result\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// startDBServer runs the db server with its policy, found in the docker
+// directory of the repository root, until the end of the test and returns
+// its address. now is the clock of the rate limits.
+func startDBServer(t *testing.T, root string, ca *spiffetest.CA, now func() time.Time) string {
+	t.Helper()
+
+	api := spiffetest.NewWorkloadAPI(t, ca, "spiffe://domain.test/db-server")
+	addr := freeAddr(t)
+
+	// The policy is read from the working directory
+	spiffetest.Chdir(t, filepath.Join(root, "docker", "db", "opa"))
+
+	for name, value := range map[string]string{
+		"addr":          addr,
+		"spiffe-socket": api.Addr(),
+		"metrics-addr":  "",
+		"log":           filepath.Join(t.TempDir(), "db.log"),
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, now)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("db server failed: %v", err)
+		}
+	})
+
+	spiffetest.WaitFor(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return addr
+}
+
+// startClient serves the HTTP API of the client of a workload, e.g.
+// external, until the end of the test and returns its URL. The client
+// authorizes the db server with the policy of the workload, found in the
+// docker directory of the repository root.
+func startClient(t *testing.T, root string, ca *spiffetest.CA, name, dbAddr string) string {
+	t.Helper()
+
+	id := "spiffe://domain.test/" + name
+	api := spiffetest.NewWorkloadAPI(t, ca, id)
+	source, err := common.NewX509Source(context.Background(), common.WithSocketPath(api.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Close() })
+
+	pool := common.NewPool(dbAddr, common.DefaultPoolConfig,
+		common.WithX509Source(source),
+		common.WithPolicyDir(filepath.Join(root, "docker", name, "opa")))
+	t.Cleanup(func() { pool.Close() })
+
+	client := &common.DBClient{Pool: pool, Source: source, ExpectedID: id}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect", client.HandleConnect)
+	mux.HandleFunc("/getdata", client.HandleGetData)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
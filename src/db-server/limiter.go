@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/opa"
+)
+
+// pruneInterval is how often the quotas of idle peers are dropped
+const pruneInterval = time.Minute
+
+// limiter enforces the rate and concurrency limits defined in the OPA policy
+// for each SPIFFE ID. Quotas are kept across connections so that reconnecting
+// does not refill the bucket, those of idle peers are dropped once refilled.
+type limiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	quotas    map[string]*quota
+	lastPrune time.Time
+}
+
+// quota is the token bucket and connection count of a single SPIFFE ID
+type quota struct {
+	limits opa.Limits
+	tokens float64
+	last   time.Time
+	conns  int
+}
+
+func newLimiter(now func() time.Time) *limiter {
+	return &limiter{
+		now:    now,
+		quotas: make(map[string]*quota),
+	}
+}
+
+// acquire reserves a connection slot for the peer. The limits evaluated for
+// the new connection replace the previous ones so that policy updates apply.
+func (l *limiter) acquire(peerID string, limits opa.Limits) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	q, ok := l.quotas[peerID]
+	if !ok {
+		q = &quota{tokens: float64(burst(limits)), last: now}
+		l.quotas[peerID] = q
+	}
+	q.limits = limits
+
+	if limits.MaxConns > 0 && q.conns >= limits.MaxConns {
+		return fmt.Errorf("too many connections for %v (max %d)", peerID, limits.MaxConns)
+	}
+	q.conns++
+	return nil
+}
+
+// release frees the connection slot reserved by acquire
+func (l *limiter) release(peerID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if q, ok := l.quotas[peerID]; ok && q.conns > 0 {
+		q.conns--
+	}
+}
+
+// allow takes a token from the peer's bucket. It returns an error if the
+// peer exceeded its rate.
+func (l *limiter) allow(peerID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q, ok := l.quotas[peerID]
+	if !ok || q.limits.Rate <= 0 {
+		return nil
+	}
+
+	now := l.now()
+	q.tokens = q.available(now)
+	q.last = now
+
+	if q.tokens < 1 {
+		return fmt.Errorf("rate limit exceeded for %v (%v/s)", peerID, q.limits.Rate)
+	}
+	q.tokens--
+	return nil
+}
+
+// prune drops the quotas of the peers without connections whose bucket is
+// full again, a new quota would be the same. It must be called with mu held.
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	for peerID, q := range l.quotas {
+		if q.conns == 0 && (q.limits.Rate <= 0 || q.available(now) >= float64(burst(q.limits))) {
+			delete(l.quotas, peerID)
+		}
+	}
+}
+
+// available returns the tokens of the bucket refilled up to now
+func (q *quota) available(now time.Time) float64 {
+	return math.Min(float64(burst(q.limits)), q.tokens+now.Sub(q.last).Seconds()*q.limits.Rate)
+}
+
+// burst returns the bucket size, defaulting to one second worth of tokens
+func burst(limits opa.Limits) int {
+	if limits.Burst > 0 {
+		return limits.Burst
+	}
+	return int(math.Max(1, math.Ceil(limits.Rate)))
+}
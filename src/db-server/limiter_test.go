@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/opa"
+)
+
+// testPeerID is the SPIFFE ID of the peer under test
+const testPeerID = "spiffe://domain.test/external"
+
+// fakeClock is the clock of a limiter under test
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter() (*limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)}
+	return newLimiter(clock.now), clock
+}
+
+func TestLimiterRate(t *testing.T) {
+	// Each step advances the clock then issues a command
+	type step struct {
+		advance time.Duration
+		allowed bool
+	}
+	tests := []struct {
+		name   string
+		limits opa.Limits
+		steps  []step
+	}{
+		{
+			name:   "burst then refill",
+			limits: opa.Limits{Rate: 1, Burst: 2},
+			steps: []step{
+				{0, true}, {0, true}, {0, false},
+				{500 * time.Millisecond, false},
+				{500 * time.Millisecond, true}, {0, false},
+			},
+		},
+		{
+			name:   "refill capped at burst",
+			limits: opa.Limits{Rate: 1, Burst: 2},
+			steps: []step{
+				{0, true}, {0, true},
+				{time.Hour, true}, {0, true}, {0, false},
+			},
+		},
+		{
+			name:   "default burst of one second",
+			limits: opa.Limits{Rate: 2.5},
+			steps:  []step{{0, true}, {0, true}, {0, true}, {0, false}, {400 * time.Millisecond, true}},
+		},
+		{
+			name:   "no rate",
+			limits: opa.Limits{MaxConns: 1},
+			steps:  []step{{0, true}, {0, true}, {0, true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter()
+			if err := l.acquire(testPeerID, tt.limits); err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				clock.advance(s.advance)
+				if err := l.allow(testPeerID); (err == nil) != s.allowed {
+					t.Errorf("step %d: got %v, want allowed=%v", i, err, s.allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterUnknownPeer(t *testing.T) {
+	l, _ := newTestLimiter()
+	if err := l.allow(testPeerID); err != nil {
+		t.Errorf("got %v for a peer without quota, want allowed", err)
+	}
+}
+
+func TestLimiterMaxConns(t *testing.T) {
+	l, _ := newTestLimiter()
+	limits := opa.Limits{MaxConns: 2}
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(testPeerID, limits); err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+	}
+	if err := l.acquire(testPeerID, limits); err == nil {
+		t.Fatal("third connection acquired, want an error")
+	}
+	if err := l.acquire("spiffe://domain.test/privileged", limits); err != nil {
+		t.Errorf("connection of another peer: %v", err)
+	}
+
+	l.release(testPeerID)
+	if err := l.acquire(testPeerID, limits); err != nil {
+		t.Errorf("connection after release: %v", err)
+	}
+
+	// The limits of a new connection replace the previous ones
+	if err := l.acquire(testPeerID, opa.Limits{}); err != nil {
+		t.Errorf("connection after the limit was lifted: %v", err)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	l, clock := newTestLimiter()
+	limits := opa.Limits{Rate: 0.05, Burst: 5} // refilled in 100s
+
+	// busy keeps its connection, drained releases it with an empty bucket
+	for _, peer := range []string{"spiffe://domain.test/busy", "spiffe://domain.test/drained"} {
+		if err := l.acquire(peer, limits); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			l.allow(peer)
+		}
+	}
+	l.release("spiffe://domain.test/drained")
+
+	// The bucket of drained is not full yet, dropping it would grant a new burst
+	clock.advance(pruneInterval)
+	l.acquire(testPeerID, limits)
+	if _, ok := l.quotas["spiffe://domain.test/drained"]; !ok {
+		t.Error("quota of a drained peer pruned before its bucket is refilled")
+	}
+
+	clock.advance(pruneInterval)
+	l.acquire(testPeerID, limits)
+	if _, ok := l.quotas["spiffe://domain.test/drained"]; ok {
+		t.Error("quota of an idle peer not pruned")
+	}
+	if _, ok := l.quotas["spiffe://domain.test/busy"]; !ok {
+		t.Error("quota of a connected peer pruned")
+	}
+}
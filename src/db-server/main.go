@@ -4,108 +4,341 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/opa-spiffe-demo/src/common"
 	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"strings"
 
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // This example assumes this workload is identified by
 // the SPIFFE ID: spiffe://domain.test/db-server
 
 var (
-	addrFlag = flag.String("addr", ":8082", "address to bind the db server to")
-	logFlag  = flag.String("log", "", "path to log to (empty=stderr)")
+	addrFlag             = flag.String("addr", ":8082", "address to bind the db server to")
+	logFlag              = flag.String("log", "", "path to log to (empty=stderr)")
+	logLevelFlag         = flag.String("log-level", "info", "minimum level of the logs (debug, info, warn, error)")
+	logFormatFlag        = flag.String("log-format", "json", "format of the logs (json, text)")
+	shutdownTimeoutFlag  = flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for in-flight requests on shutdown")
+	idleTimeoutFlag      = flag.Duration("idle-timeout", 2*time.Minute, "time a connection may wait for the next request (0=no limit)")
+	requestTimeoutFlag   = flag.Duration("request-timeout", 10*time.Second, "time allowed to receive a request and send the response (0=no limit)")
+	maxRequestSizeFlag   = flag.Int("max-request-size", 4096, "maximum size of a request in bytes (0=no limit)")
+	handshakeTimeoutFlag = flag.Duration("handshake-timeout", 10*time.Second, "time allowed to complete the mTLS handshake")
+	metricsAddrFlag      = flag.String("metrics-addr", ":9082", "address to serve Prometheus metrics on (empty=disabled)")
+	otlpEndpointFlag     = flag.String("otlp-endpoint", "", "OTLP/HTTP collector address to export traces to (empty=disabled)")
+	policyTimeFlag       = flag.String("policy-time", "", "RFC 3339 instant the policies are evaluated at, e.g. 2024-01-01T09:00:00Z (empty=now)")
+	policyTZFlag         = flag.String("policy-tz", "", "IANA time zone the policies evaluate days in, e.g. America/New_York (empty=UTC)")
+	socketFlag           = flag.String("spiffe-socket", "", "Workload API address (empty=$SPIFFE_ENDPOINT_SOCKET or "+common.DefaultSocketPath+")")
+	svidCertFlag         = flag.String("svid-cert", "", "PEM file of the X509-SVID, used instead of the Workload API (empty=Workload API)")
+	svidKeyFlag          = flag.String("svid-key", "", "PEM file of the X509-SVID private key, required with -svid-cert")
+	svidBundleFlag       = flag.String("svid-bundle", "", "PEM file of the X509 bundle of the trust domain, required with -svid-cert")
+	fedBundlesFlag       = flag.String("federated-bundles", "", "comma separated td=path bundles of federated trust domains, SPIFFE bundles (.json) or PEM (empty=none)")
+	fedEndpointsFlag     = flag.String("federated-endpoints", "", "comma separated td=url or td=url|spiffe-id bundle endpoints of federated trust domains (empty=none)")
 )
 
+// tracer creates the spans of the db commands
+var tracer = otel.Tracer("db-server")
+
 func main() {
-	if err := run(context.Background()); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel the context on SIGINT/SIGTERM to trigger a graceful shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Info("received signal, shutting down...", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := run(ctx, time.Now); err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) (err error) {
+// run serves until ctx is cancelled, now is the clock of the rate limits
+func run(ctx context.Context, now func() time.Time) (err error) {
 	flag.Parse()
-	log.SetPrefix("db> ")
-	log.SetFlags(log.Ltime)
+	logOutput := io.Writer(os.Stdout)
 	if *logFlag != "" {
 		logFile, err := os.OpenFile(*logFlag, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
 			return fmt.Errorf("unable to open log file: %v", err)
 		}
 		defer logFile.Close()
-		log.SetOutput(logFile)
-	} else {
-		log.SetOutput(os.Stdout)
+		logOutput = logFile
 	}
+	if err := common.InitLogging(logOutput, *logFormatFlag, *logLevelFlag, "db"); err != nil {
+		return err
+	}
+
+	slog.Info("starting db server...")
 
-	log.Printf("starting db server...")
+	// Connections are only limited once the peer is known, the handshake must not hang
+	if *handshakeTimeoutFlag <= 0 {
+		return fmt.Errorf("invalid handshake timeout %v", *handshakeTimeoutFlag)
+	}
+
+	// Policies may be evaluated at a simulated instant and in the time zone of the partners
+	policyClock, err := opa.ClockFromFlags(*policyTimeFlag, *policyTZFlag)
+	if err != nil {
+		return err
+	}
+	opa.SetClock(policyClock)
 
-	listener := common.CreateTLSLIstener(ctx, *addrFlag)
+	shutdownTracing, err := common.InitTracing(ctx, "db-server", *otlpEndpointFlag)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
 
-	defer listener.Close()
+	if *metricsAddrFlag != "" {
+		metricsServer := &http.Server{Addr: *metricsAddrFlag, Handler: promhttp.Handler()}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("unable to serve metrics", "error", err)
+			}
+		}()
+		defer metricsServer.Close()
+	}
 
-	log.Printf("listening on %s...", listener.Addr())
+	// Share a single Workload API connection, or SVID files, SVIDs are rotated in the background
+	source, err := common.NewX509SourceFromFlags(ctx, *svidCertFlag, *svidKeyFlag, *svidBundleFlag, common.WithSocketPath(*socketFlag))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
 
-	// Handle connections
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			go handleError(err)
-		}
-		go handleConnection(conn)
+	// Clients of partner trust domains are authenticated with their federated bundles
+	listenOptions := []common.Option{common.WithX509Source(source), common.WithAuthorizer(tlsconfig.AuthorizeAny())}
+	federated, err := common.NewFederatedBundlesFromFlags(ctx, *fedBundlesFlag, *fedEndpointsFlag, source)
+	if err != nil {
+		return err
+	}
+	if federated != nil {
+		listenOptions = append(listenOptions, common.WithFederatedBundles(federated))
+	}
+
+	// Clients are authorized on each request so that they can be told why they are denied
+	listener, err := common.CreateTLSLIstener(ctx, *addrFlag, listenOptions...)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("listening...", "addr", listener.Addr().String())
+
+	// Handle connections until the context is cancelled or the listener fails
+	srv := newServer(listener, config{
+		handshakeTimeout: *handshakeTimeoutFlag,
+		idleTimeout:      *idleTimeoutFlag,
+		requestTimeout:   *requestTimeoutFlag,
+		maxRequestSize:   *maxRequestSizeFlag,
+		trustDomain:      common.TrustDomainOf(source),
+		now:              now,
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.serve()
+	}()
+
+	select {
+	case err = <-errCh:
+		slog.Error("listener failed", "error", err)
+	case <-ctx.Done():
+		slog.Info("draining connections...")
 	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+	defer cancel()
+
+	if shutdownErr := srv.shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = fmt.Errorf("unable to shut down cleanly: %v", shutdownErr)
+	}
+
+	slog.Info("db server stopped")
+	return err
 }
 
-func handleConnection(conn net.Conn) {
+func (s *server) handleConnection(conn net.Conn) {
 
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	defer conn.Close()
 
+	connCtx := common.WithLogAttrs(context.Background(), "conn_id", common.NewRequestID(), "remote_addr", conn.RemoteAddr().String())
+
+	// Run the handshake upfront so that its duration is recorded
+	if s.cfg.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.cfg.handshakeTimeout))
+	}
+	if err := common.Handshake(conn); err != nil {
+		slog.WarnContext(connCtx, "Handshake failed - close this connection.", "error", err)
+		return
+	}
+
+	id, _ := spiffetls.PeerIDFromConn(conn)
+	peerID := id.String()
+	connCtx = common.WithLogAttrs(connCtx, "peer_id", peerID)
+
+	// Reserve a connection slot for the peer before it may stay idle, any
+	// SVID completing the handshake since peers are authorized per request
+	limits, err := opa.GetLimitsFromPolicy(connCtx, peerID)
+	if err != nil {
+		slog.ErrorContext(connCtx, "Unable to get limits - close this connection.", "error", err)
+		s.awaitRequest(conn, rw.Reader)
+		common.WriteError(conn, common.StatusInternal, "unable to evaluate limits")
+		return
+	}
+	if err := s.limiter.acquire(peerID, limits); err != nil {
+		slog.WarnContext(connCtx, "Throttled - close this connection.", "reason", err.Error())
+		s.awaitRequest(conn, rw.Reader)
+		s.reject(connCtx, conn, common.StatusThrottled, err.Error())
+		return
+	}
+	defer s.limiter.release(peerID)
+
 	for {
-		cmd, err := rw.ReadString('\n')
+		line, err := s.readRequest(conn, rw.Reader)
 		switch {
 		case err == io.EOF:
-			log.Println("Reached EOF - close this connection.\n   ---")
+			slog.DebugContext(connCtx, "Reached EOF - close this connection.")
+			return
+		case err == errIdleTimeout:
+			slog.InfoContext(connCtx, "Idle timeout - close this connection.")
+			s.reject(connCtx, conn, common.StatusIdleTimeout, "connection idle for too long")
+			return
+		case err == errRequestTimeout:
+			slog.WarnContext(connCtx, "Request timeout - close this connection.")
+			s.reject(connCtx, conn, common.StatusRequestTimeout, "request not received in time")
+			return
+		case err == errRequestTooLarge:
+			slog.WarnContext(connCtx, "Request too large - close this connection.")
+			s.reject(connCtx, conn, common.StatusRequestTooLarge, fmt.Sprintf("request exceeds %d bytes", s.cfg.maxRequestSize))
+			return
+		case err != nil && s.isClosing():
+			// shutdown closes the idle connections
+			slog.DebugContext(connCtx, "Shutting down - idle connection closed.")
 			return
 		case err != nil:
-			log.Printf("Error: %v\n", err)
+			slog.ErrorContext(connCtx, "Unable to read request", "error", err)
 			return
 		}
 
-		log.Printf("Client says: %q", cmd)
+		ctx, cmd := common.ParseCommand(connCtx, line)
+		ctx = common.WithLogAttrs(ctx, "request_id", common.NewRequestID())
+
+		if !s.begin(conn) {
+			slog.InfoContext(ctx, "Shutting down - dropping request", "command", cmd)
+			return
+		}
+
+		slog.InfoContext(ctx, "Client says", "command", cmd)
+
+		// Trace the command as part of the client's trace
+		ctx, span := tracer.Start(ctx, "db.command",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("db.command", commandName(cmd)),
+				attribute.String("spiffe.peer_id", peerID),
+			))
+
+		// Authorize every request since a pooled connection outlives the
+		// decision, e.g. external gets blocked at midnight. A denied client is
+		// told why before the connection is closed.
+		var denied *opa.DeniedError
+		if err := opa.Authorizer(ctx, opa.RoleServer, peerID, s.cfg.trustDomain, nil); errors.As(err, &denied) {
+			commandsTotal.WithLabelValues(peerID, commandName(cmd), "denied").Inc()
+			s.deny(ctx, conn, denied)
+			span.SetAttributes(attribute.String("db.status", "denied"))
+			span.End()
+			s.end(conn)
+			return
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Unable to authorize peer - close this connection.", "error", err)
+			common.WriteError(conn, common.StatusInternal, "unable to evaluate policy")
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			s.end(conn)
+			return
+		}
 
 		// Send a response back to the client
-		if strings.HasPrefix(cmd, "/getdata") {
-			data := generateTestData()
-			data = getObfuscateResult(conn, data)
+		start := time.Now()
+		status, err := s.serveCommand(ctx, conn, peerID, cmd)
+		commandsTotal.WithLabelValues(peerID, commandName(cmd), status).Inc()
+		commandDuration.WithLabelValues(commandName(cmd)).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.String("db.status", status))
+		if status == "error" {
+			span.SetStatus(codes.Error, "unable to serve command")
+		}
+		span.End()
+		if err != nil {
+			slog.ErrorContext(ctx, "Unable to send response", "error", err)
+			return
+		}
 
-			encoder := json.NewEncoder(conn)
+		if !s.end(conn) {
+			slog.InfoContext(ctx, "Shutting down - close this connection.")
+			return
+		}
+	}
+}
 
-			if err := encoder.Encode(data); err != nil {
-				log.Printf("Encoding error: %v\n", err)
-			}
-		} else {
-			id, _ := spiffetls.PeerIDFromConn(conn)
-			_, err = conn.Write([]byte(fmt.Sprintf("Hello %v\n", id)))
-			if err != nil {
-				log.Printf("Unable to send response: %v", err)
-				return
-			}
+// serveCommand sends the response to a command. It returns the status of
+// the command and an error if the response could not be sent.
+func (s *server) serveCommand(ctx context.Context, conn net.Conn, peerID, cmd string) (string, error) {
+	if err := s.limiter.allow(peerID); err != nil {
+		slog.WarnContext(ctx, "Throttled", "reason", err.Error())
+		return "throttled", common.WriteError(conn, common.StatusThrottled, err.Error())
+	}
+
+	if strings.HasPrefix(cmd, "/getdata") {
+		data := generateTestData()
+		data = getObfuscateResult(ctx, conn, data)
+
+		_, span := tracer.Start(ctx, "db.encode")
+		defer span.End()
+
+		encoder := json.NewEncoder(conn)
+
+		if err := encoder.Encode(data); err != nil {
+			slog.ErrorContext(ctx, "Encoding error", "error", err)
+			span.SetStatus(codes.Error, err.Error())
+			return "error", nil
 		}
+		return "ok", nil
+	}
+
+	_, err := conn.Write([]byte(fmt.Sprintf("Hello %v\n", peerID)))
+	if err != nil {
+		return "error", err
 	}
+	return "ok", nil
 }
 
 func handleError(err error) {
-	log.Printf("Unable to accept connection: %v", err)
+	slog.Error("Unable to accept connection", "error", err)
 }
 
 func generateTestData() []common.Patient {
@@ -144,9 +377,9 @@ func generateTestData() []common.Patient {
 	return patients
 }
 
-func getObfuscateResult(conn net.Conn, original []common.Patient) []common.Patient {
+func getObfuscateResult(ctx context.Context, conn net.Conn, original []common.Patient) []common.Patient {
 	id, _ := spiffetls.PeerIDFromConn(conn)
-	fields, err := opa.GetPiiFromPolicy(id.String())
+	fields, err := opa.GetPiiFromPolicy(ctx, id.String())
 
 	if err != nil {
 		return []common.Patient{}
@@ -161,6 +394,7 @@ func getObfuscateResult(conn net.Conn, original []common.Patient) []common.Patie
 
 	for _, field := range fields {
 		filterMap[field.(string)] = true
+		maskedFieldsTotal.WithLabelValues(id.String(), field.(string)).Add(float64(len(original)))
 	}
 
 	// build a new result based on the fields to filter
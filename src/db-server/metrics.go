@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// commandsTotal counts the commands served by SPIFFE ID, command and status
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_commands_total",
+		Help: "Number of db commands by peer SPIFFE ID, command and status.",
+	}, []string{"peer_id", "command", "status"})
+
+	// commandDuration observes the time spent serving commands
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_command_duration_seconds",
+		Help:    "Time spent serving db commands.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command"})
+
+	// maskedFieldsTotal counts the patient fields masked by the PII policy
+	maskedFieldsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_masked_fields_total",
+		Help: "Number of patient fields masked by peer SPIFFE ID and field.",
+	}, []string{"peer_id", "field"})
+
+	// violationsTotal counts the connections closed by the server by protocol status
+	violationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_violations_total",
+		Help: "Number of connections closed by the server by protocol status, e.g. IDLE_TIMEOUT or DENIED.",
+	}, []string{"status"})
+)
+
+func init() {
+	prometheus.MustRegister(commandsTotal, commandDuration, maskedFieldsTotal, violationsTotal)
+}
+
+// commandName returns the metric label of a command
+func commandName(cmd string) string {
+	if strings.HasPrefix(cmd, "/getdata") {
+		return "getdata"
+	}
+	return "hello"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/opa"
+)
+
+// rejectTimeout bounds the time spent sending a protocol error to a misbehaving peer
+const rejectTimeout = time.Second
+
+var (
+	errIdleTimeout     = errors.New("idle timeout")
+	errRequestTimeout  = errors.New("request timeout")
+	errRequestTooLarge = errors.New("request too large")
+)
+
+// config holds the connection limits of the server. A zero value disables the limit.
+type config struct {
+	// trustDomain is the trust domain of the server, clients of other trust domains are federated
+	trustDomain string
+	// handshakeTimeout is the time allowed to complete the mTLS handshake
+	handshakeTimeout time.Duration
+	// idleTimeout is the time a connection may wait for the next request
+	idleTimeout time.Duration
+	// requestTimeout is the time allowed to receive a request and send the response
+	requestTimeout time.Duration
+	// maxRequestSize is the maximum size of a request line in bytes
+	maxRequestSize int
+	// now is the clock of the rate limits, time.Now if nil
+	now func() time.Time
+}
+
+// readRequest reads a newline terminated request. The connection may stay
+// idle for the idle timeout before the request starts, then the request must
+// be received and answered within the request timeout.
+func (s *server) readRequest(conn net.Conn, r *bufio.Reader) (string, error) {
+	conn.SetDeadline(time.Time{})
+	if s.cfg.idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.cfg.idleTimeout))
+	}
+
+	if _, err := r.Peek(1); err != nil {
+		if isTimeout(err) {
+			return "", errIdleTimeout
+		}
+		return "", err
+	}
+
+	if s.cfg.requestTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.cfg.requestTimeout))
+	}
+
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if s.cfg.maxRequestSize > 0 && len(line) > s.cfg.maxRequestSize {
+			return "", errRequestTooLarge
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case isTimeout(err):
+			return "", errRequestTimeout
+		case err != nil:
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+// reject sends a protocol error to the peer before the connection is closed
+// and counts the violation
+func (s *server) reject(ctx context.Context, conn net.Conn, status, message string) {
+	violationsTotal.WithLabelValues(status).Inc()
+
+	conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	if err := common.WriteError(conn, status, message); err != nil {
+		slog.WarnContext(ctx, "Unable to send response", "status", status, "error", err)
+	}
+}
+
+// awaitRequest waits for the first request of the peer, within rejectTimeout,
+// before the connection is rejected. The peer then reads the rejection as the
+// response instead of seeing its request reset by the closed connection.
+func (s *server) awaitRequest(conn net.Conn, r *bufio.Reader) {
+	conn.SetReadDeadline(time.Now().Add(rejectTimeout))
+	r.ReadSlice('\n')
+}
+
+// deny sends the reason of a policy denial to the peer before the connection is closed
+func (s *server) deny(ctx context.Context, conn net.Conn, denied *opa.DeniedError) {
+	violationsTotal.WithLabelValues(common.StatusDenied).Inc()
+
+	conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	if err := common.WriteDenial(conn, denied.DecisionID, denied.Rule, denied.Error(), denied.Reasons); err != nil {
+		slog.WarnContext(ctx, "Unable to send response", "status", common.StatusDenied, "error", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
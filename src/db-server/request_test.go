@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadRequest(t *testing.T) {
+	cfg := config{
+		idleTimeout:    100 * time.Millisecond,
+		requestTimeout: 100 * time.Millisecond,
+		maxRequestSize: 32,
+	}
+
+	tests := []struct {
+		name string
+		// send writes to the client side of the connection
+		send       func(conn net.Conn)
+		bufferSize int
+		want       string
+		wantErr    error
+	}{
+		{
+			name: "request",
+			send: func(conn net.Conn) { io.WriteString(conn, "/getdata\n") },
+			want: "/getdata\n",
+		},
+		{
+			name: "request sent in chunks",
+			send: func(conn net.Conn) {
+				io.WriteString(conn, "Hello ")
+				time.Sleep(20 * time.Millisecond)
+				io.WriteString(conn, "server\n")
+			},
+			want: "Hello server\n",
+		},
+		{
+			name:    "idle",
+			send:    func(net.Conn) {},
+			wantErr: errIdleTimeout,
+		},
+		{
+			name:    "request not terminated",
+			send:    func(conn net.Conn) { io.WriteString(conn, "/getdata") },
+			wantErr: errRequestTimeout,
+		},
+		{
+			name:    "request too large",
+			send:    func(conn net.Conn) { io.WriteString(conn, strings.Repeat("a", 40)+"\n") },
+			wantErr: errRequestTooLarge,
+		},
+		{
+			name:       "request too large for the buffer",
+			send:       func(conn net.Conn) { io.WriteString(conn, strings.Repeat("a", 60)) },
+			bufferSize: 16,
+			wantErr:    errRequestTooLarge,
+		},
+		{
+			name:    "closed",
+			send:    func(conn net.Conn) { conn.Close() },
+			wantErr: io.EOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srvConn, cliConn := net.Pipe()
+			defer srvConn.Close()
+			defer cliConn.Close()
+			go tt.send(cliConn)
+
+			r := bufio.NewReader(srvConn)
+			if tt.bufferSize > 0 {
+				r = bufio.NewReaderSize(srvConn, tt.bufferSize)
+			}
+			s := &server{cfg: cfg}
+			got, err := s.readRequest(srvConn, r)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("got %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadRequestNoLimits(t *testing.T) {
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	// Without limits the request may come late and be of any size
+	line := strings.Repeat("a", 8192) + "\n"
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(cliConn, line)
+	}()
+
+	s := &server{}
+	got, err := s.readRequest(srvConn, bufio.NewReader(srvConn))
+	if err != nil || got != line {
+		t.Errorf("got %d bytes, %v, want %d bytes", len(got), err, len(line))
+	}
+}
+
+func TestRejectCountsViolation(t *testing.T) {
+	srvConn, cliConn := net.Pipe()
+	defer srvConn.Close()
+	defer cliConn.Close()
+
+	before := testutil.ToFloat64(violationsTotal.WithLabelValues(common.StatusIdleTimeout))
+
+	done := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(cliConn).ReadString('\n')
+		done <- line
+	}()
+	s := &server{}
+	s.reject(context.Background(), srvConn, common.StatusIdleTimeout, "connection idle for too long")
+
+	if got, want := <-done, "ERR IDLE_TIMEOUT connection idle for too long\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := testutil.ToFloat64(violationsTotal.WithLabelValues(common.StatusIdleTimeout)); got != before+1 {
+		t.Errorf("got %v violations, want %v", got, before+1)
+	}
+}
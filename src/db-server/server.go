@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxAcceptDelay is the upper bound of the backoff applied after a transient accept error
+const maxAcceptDelay = time.Second
+
+// server accepts connections and keeps track of them so that in-flight
+// requests can be drained on shutdown
+type server struct {
+	listener net.Listener
+	limiter  *limiter
+	cfg      config
+
+	mu      sync.Mutex
+	closing bool
+	conns   map[net.Conn]bool // true while the connection is serving a request
+	wg      sync.WaitGroup
+}
+
+func newServer(listener net.Listener, cfg config) *server {
+	now := cfg.now
+	if now == nil {
+		now = time.Now
+	}
+	return &server{
+		listener: listener,
+		limiter:  newLimiter(now),
+		cfg:      cfg,
+		conns:    make(map[net.Conn]bool),
+	}
+}
+
+// serve accepts connections until the listener is closed. It returns nil
+// when the server is shut down and an error if the listener fails permanently.
+func (s *server) serve() error {
+	var delay time.Duration
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return nil
+			}
+			if isTransientAcceptError(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				handleError(err)
+				time.Sleep(delay)
+				continue
+			}
+			return fmt.Errorf("unable to accept connection: %v", err)
+		}
+		delay = 0
+
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// isTransientAcceptError tells whether Accept may succeed on retry, e.g. once
+// a connection aborted by the peer is skipped or file descriptors are freed
+func isTransientAcceptError(err error) bool {
+	return errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		isTimeout(err)
+}
+
+// shutdown stops accepting new connections, closes idle ones and waits for
+// in-flight requests to complete. Connections still busy when ctx is done are
+// closed forcibly.
+func (s *server) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	err := s.listener.Close()
+	for conn, active := range s.conns {
+		if !active {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		slog.Warn("drain deadline exceeded, closing connections", "count", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// begin marks the connection as serving a request. It returns false if the
+// server is shutting down and the request must not be served.
+func (s *server) begin(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+// end marks the connection as idle. It returns false if the server is shutting
+// down and the connection should be closed.
+func (s *server) end(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = false
+	return !s.closing
+}
+
+func (s *server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	s.wg.Add(1)
+	return true
+}
+
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
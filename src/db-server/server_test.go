@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/opa-spiffe-demo/src/opa"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+func TestIsTransientAcceptError(t *testing.T) {
+	acceptError := func(err error) error {
+		return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", err)}
+	}
+
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{acceptError(syscall.ECONNABORTED), true},
+		{acceptError(syscall.EMFILE), true},
+		{acceptError(syscall.ENFILE), true},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.ErrDeadlineExceeded}, true},
+		{acceptError(syscall.EINVAL), false},
+		{net.ErrClosed, false},
+		{errors.New("tls: handshake failure"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientAcceptError(tt.err); got != tt.want {
+			t.Errorf("isTransientAcceptError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// startServer serves the db server with the policy of docker/db/opa until the
+// end of the test, like run does, and returns its address
+func startServer(t *testing.T, ca *spiffetest.CA) string {
+	t.Helper()
+	return startServerWith(t, ca, config{}).listener.Addr().String()
+}
+
+// startServerWith serves the db server like startServer with the limits of cfg
+func startServerWith(t *testing.T, ca *spiffetest.CA, cfg config) *server {
+	t.Helper()
+
+	spiffetest.Chdir(t, filepath.Join("..", "..", "docker", "db", "opa"))
+
+	listener, err := common.CreateTLSLIstener(context.Background(), "127.0.0.1:0",
+		common.WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		common.WithAuthorizer(tlsconfig.AuthorizeAny()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.trustDomain = ca.TrustDomain().String()
+	srv := newServer(listener, cfg)
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.serve()
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.shutdown(ctx)
+		if err := <-done; err != nil {
+			t.Errorf("db server failed: %v", err)
+		}
+	})
+	return srv
+}
+
+// TestPolicyAppliesToPooledConnections reuses a pooled connection of external
+// authorized on a Tuesday once the clock of the policy moved to a Monday
+func TestPolicyAppliesToPooledConnections(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr := startServer(t, ca)
+	t.Cleanup(func() { opa.SetClock(func() time.Time { return time.Now().UTC() }) })
+
+	pool := common.NewPool(addr, common.PoolConfig{MaxIdle: 1},
+		common.WithX509Source(ca.X509Source("spiffe://domain.test/external")),
+		common.WithAuthorizer(tlsconfig.AuthorizeAny()))
+	defer pool.Close()
+
+	// hello sends a command on a pooled connection and returns the connection used
+	hello := func() (net.Conn, error) {
+		ctx := context.Background()
+		conn, err := pool.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		err = common.WriteCommand(ctx, conn, "Hello server")
+		if err == nil {
+			_, err = common.ReadData(ctx, conn, "spiffe://domain.test/external")
+		}
+		if err != nil {
+			conn.Discard()
+		}
+		return conn.Conn, err
+	}
+
+	opa.SetClock(opa.FixedClock(tuesday))
+	first, err := hello()
+	if err != nil {
+		t.Fatalf("on Tuesday: %v", err)
+	}
+
+	opa.SetClock(opa.FixedClock(monday))
+	second, err := hello()
+	if second != first {
+		t.Fatal("pooled connection not reused")
+	}
+	var aerr *common.AuthorizationError
+	if !errors.As(err, &aerr) || !aerr.Remote {
+		t.Fatalf("on Monday: got %v, want a denial from the db server", err)
+	}
+	if want := []string{"external is blocked on Mondays"}; !reflect.DeepEqual(aerr.Reasons, want) {
+		t.Errorf("got reasons %q, want %q", aerr.Reasons, want)
+	}
+}
+
+// TestConnectionSlotTakenOnHandshake opens the connections external may keep
+// open without sending any request, the next connection is throttled
+func TestConnectionSlotTakenOnHandshake(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	srv := startServerWith(t, ca, config{})
+	addr := srv.listener.Addr().String()
+	external := common.WithX509Source(ca.X509Source("spiffe://domain.test/external"))
+
+	ctx := context.Background()
+	dial := func() net.Conn {
+		conn, err := common.CreateTLSDialer(ctx, addr, external, common.WithAuthorizer(tlsconfig.AuthorizeAny()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	// The policy allows external 2 connections
+	dial()
+	dial()
+	spiffetest.WaitFor(t, func() bool {
+		srv.limiter.mu.Lock()
+		defer srv.limiter.mu.Unlock()
+		q, ok := srv.limiter.quotas["spiffe://domain.test/external"]
+		return ok && q.conns == 2
+	})
+
+	conn := dial()
+	if err := common.WriteCommand(ctx, conn, "Hello server"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := common.ReadData(ctx, conn, "spiffe://domain.test/external")
+	var perr *common.ProtocolError
+	if !errors.As(err, &perr) || perr.Status != common.StatusThrottled {
+		t.Errorf("got %v, want %s", err, common.StatusThrottled)
+	}
+}
+
+// TestHandshakeTimeout closes a connection never starting the handshake,
+// even though idle connections are not timed out
+func TestHandshakeTimeout(t *testing.T) {
+	ca := spiffetest.NewCA(t, "domain.test")
+	srv := startServerWith(t, ca, config{handshakeTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want the server to close the connection", err)
+	}
+}
+
+// heldListener accepts mTLS connections whose writes block while the listener
+// is held, keeping the request being answered in flight
+type heldListener struct {
+	net.Listener
+
+	mu   sync.Mutex
+	held chan struct{} // closed on release, nil when not held
+}
+
+func (l *heldListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &heldConn{Conn: conn, listener: l, closed: make(chan struct{})}, nil
+}
+
+func (l *heldListener) hold() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = make(chan struct{})
+}
+
+func (l *heldListener) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held != nil {
+		close(l.held)
+		l.held = nil
+	}
+}
+
+func (l *heldListener) gate() chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+type heldConn struct {
+	net.Conn
+	listener *heldListener
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (c *heldConn) Write(b []byte) (int, error) {
+	if held := c.listener.gate(); held != nil {
+		select {
+		case <-held:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *heldConn) Handshake() error {
+	return common.Handshake(c.Conn)
+}
+
+func (c *heldConn) PeerID() (spiffeid.ID, error) {
+	return spiffetls.PeerIDFromConn(c.Conn)
+}
+
+func (c *heldConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// drainSetup is a db server whose writes can be held and a client connected to it
+type drainSetup struct {
+	srv      *server
+	listener *heldListener
+	conn     net.Conn
+	served   chan error
+}
+
+// newDrainSetup serves the db server with the policy of docker/db/opa and
+// connects privileged to it, the connection being idle after a first request
+func newDrainSetup(t *testing.T) *drainSetup {
+	t.Helper()
+	spiffetest.Chdir(t, filepath.Join("..", "..", "docker", "db", "opa"))
+
+	ca := spiffetest.NewCA(t, "domain.test")
+	inner, err := common.CreateTLSLIstener(context.Background(), "127.0.0.1:0",
+		common.WithX509Source(ca.X509Source("spiffe://domain.test/db-server")),
+		common.WithAuthorizer(tlsconfig.AuthorizeAny()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &heldListener{Listener: inner}
+	t.Cleanup(listener.release)
+
+	d := &drainSetup{
+		srv:      newServer(listener, config{trustDomain: "domain.test"}),
+		listener: listener,
+		served:   make(chan error, 1),
+	}
+	go func() {
+		d.served <- d.srv.serve()
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	d.conn, err = common.CreateTLSDialer(context.Background(), listener.Addr().String(),
+		common.WithX509Source(ca.X509Source("spiffe://domain.test/privileged")),
+		common.WithAuthorizer(tlsconfig.AuthorizeAny()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.conn.Close() })
+	if err := d.send(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.read(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func (d *drainSetup) send() error {
+	return common.WriteCommand(context.Background(), d.conn, "Hello server")
+}
+
+func (d *drainSetup) read() (string, error) {
+	return common.ReadData(context.Background(), d.conn, "spiffe://domain.test/privileged")
+}
+
+// inFlight sends a request whose response is held until release
+func (d *drainSetup) inFlight(t *testing.T) {
+	t.Helper()
+	d.listener.hold()
+	if err := d.send(); err != nil {
+		t.Fatal(err)
+	}
+	spiffetest.WaitFor(t, func() bool {
+		d.srv.mu.Lock()
+		defer d.srv.mu.Unlock()
+		for _, active := range d.srv.conns {
+			if active {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// shutdown shuts the server down in the background with the given drain deadline
+func (d *drainSetup) shutdown(timeout time.Duration) chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- d.srv.shutdown(ctx)
+	}()
+	return done
+}
+
+func TestShutdownCompletesInFlightRequest(t *testing.T) {
+	d := newDrainSetup(t)
+	d.inFlight(t)
+
+	done := d.shutdown(5 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned %v with a request in flight", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	d.listener.release()
+	if got, err := d.read(); err != nil || got != "Hello spiffe://domain.test/privileged\n" {
+		t.Errorf("got %q, %v, want the response of the request in flight", got, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if err := <-d.served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+
+	// The connection is closed once the request is answered
+	if _, err := d.read(); err == nil {
+		t.Error("connection still open after shutdown")
+	}
+}
+
+func TestShutdownClosesIdleConnection(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	d := newDrainSetup(t)
+	done := d.shutdown(5 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+
+	var ioerr *common.IOError
+	if _, err := d.read(); !errors.As(err, &ioerr) {
+		t.Errorf("got %v, want the idle connection to be closed", err)
+	}
+	if strings.Contains(logs.String(), "Unable to read request") {
+		t.Errorf("closing the idle connection was logged as a read error:\n%s", logs.String())
+	}
+}
+
+func TestShutdownForceClosesAfterDeadline(t *testing.T) {
+	d := newDrainSetup(t)
+	d.inFlight(t)
+
+	start := time.Now()
+	if err := <-d.shutdown(200 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+	if _, err := d.read(); err == nil {
+		t.Error("got a response after the connection was closed")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opa-spiffe-demo/src/common"
+	"github.com/opa-spiffe-demo/src/common/spiffetest"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestTraceAcrossTheWire follows a /getdata command from the span of the
+// client to the db.command span of the server and the OPA evaluation of the
+// PII policy. The global tracer provider is only set by this test, the
+// tracers created before delegate to the first one installed.
+func TestTraceAcrossTheWire(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := common.NewTracerProvider("db-server-test", sdktrace.WithSyncer(exporter))
+	defer tp.Shutdown(context.Background())
+
+	ca := spiffetest.NewCA(t, "domain.test")
+	addr := startServer(t, ca)
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "client")
+	conn, err := common.CreateTLSDialer(ctx, addr,
+		common.WithX509Source(ca.X509Source("spiffe://domain.test/restricted")),
+		common.WithAuthorizer(tlsconfig.AuthorizeAny()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := common.WriteCommand(ctx, conn, "/getdata"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.ReadDataJSON(ctx, conn, "spiffe://domain.test/restricted"); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+	traceID := span.SpanContext().TraceID()
+
+	// The server ends its spans after sending the response
+	var command, piiEval tracetest.SpanStub
+	spiffetest.WaitFor(t, func() bool {
+		command, piiEval = tracetest.SpanStub{}, tracetest.SpanStub{}
+		for _, s := range exporter.GetSpans() {
+			switch {
+			case s.Name == "db.command":
+				command = s
+			case s.Name == "opa.eval" && hasAttribute(s, attribute.String("opa.query", "data.example.pii")):
+				piiEval = s
+			}
+		}
+		return command.Name != "" && piiEval.Name != ""
+	})
+
+	if got := command.SpanContext.TraceID(); got != traceID {
+		t.Errorf("db.command span in trace %v, want %v", got, traceID)
+	}
+	if got, want := command.Parent.SpanID(), span.SpanContext().SpanID(); got != want || !command.Parent.IsRemote() {
+		t.Errorf("db.command span child of %v (remote %v), want the remote client span %v", got, command.Parent.IsRemote(), want)
+	}
+	if command.SpanKind != trace.SpanKindServer {
+		t.Errorf("db.command span of kind %v, want server", command.SpanKind)
+	}
+	if !hasAttribute(command, attribute.String("spiffe.peer_id", "spiffe://domain.test/restricted")) {
+		t.Errorf("db.command span attributes %v, want the peer ID", command.Attributes)
+	}
+	if got := piiEval.SpanContext.TraceID(); got != traceID {
+		t.Errorf("opa.eval span in trace %v, want %v", got, traceID)
+	}
+	if got, want := piiEval.Parent.SpanID(), command.SpanContext.SpanID(); got != want {
+		t.Errorf("opa.eval span child of %v, want db.command %v", got, want)
+	}
+}
+
+func hasAttribute(s tracetest.SpanStub, attr attribute.KeyValue) bool {
+	for _, a := range s.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
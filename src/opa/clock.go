@@ -0,0 +1,53 @@
+package opa
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	clockMu sync.RWMutex
+	clock   = func() time.Time { return time.Now().UTC() }
+)
+
+// SetClock sets the clock of the policy evaluations, e.g. to pin the time in
+// tests. The time is given to the policies as input.now_ns and its location as
+// input.tz, e.g. "America/New_York". It defaults to time.Now in UTC.
+func SetClock(now func() time.Time) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	clock = now
+}
+
+// FixedClock returns a clock stopped at t, e.g. to simulate a decision
+func FixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+// ClockFromFlags returns the clock stopped at an RFC 3339 instant, or the
+// current time if at is empty, in the IANA time zone tz, or UTC if tz is empty
+func ClockFromFlags(at, tz string) (func() time.Time, error) {
+	loc := time.UTC
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("invalid policy time zone %q: %v", tz, err)
+		}
+	}
+	if at == "" {
+		return func() time.Time { return time.Now().In(loc) }, nil
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy time %q: %v", at, err)
+	}
+	return FixedClock(t.In(loc)), nil
+}
+
+// now returns the time of the clock
+func now() time.Time {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return clock()
+}
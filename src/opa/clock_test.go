@@ -0,0 +1,81 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClockFromFlags(t *testing.T) {
+	clock, err := ClockFromFlags("2024-01-01T03:00:00Z", "America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := clock()
+	if want := time.Date(2024, time.January, 1, 3, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got.Location().String() != "America/New_York" {
+		t.Errorf("got location %v, want America/New_York", got.Location())
+	}
+
+	clock, err = ClockFromFlags("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := clock(); got.Location() != time.UTC || time.Since(got) > time.Minute {
+		t.Errorf("got %v, want the current time in UTC", got)
+	}
+
+	for _, flags := range [][2]string{{"monday", ""}, {"", "Mars/Olympus_Mons"}} {
+		if _, err := ClockFromFlags(flags[0], flags[1]); err == nil {
+			t.Errorf("ClockFromFlags(%q, %q) succeeded, want an error", flags[0], flags[1])
+		}
+	}
+}
+
+// TestExternalDaysInTimeZone evaluates the db policy, which blocks external
+// on Mondays, Wednesdays and Fridays, in UTC and in New York
+func TestExternalDaysInTimeZone(t *testing.T) {
+	chdir(t, filepath.Join("..", "..", "docker", "db", "opa"))
+	t.Cleanup(func() { SetClock(func() time.Time { return time.Now().UTC() }) })
+
+	tests := []struct {
+		at, tz  string
+		blocked bool
+	}{
+		{"2024-01-01T03:00:00Z", "", true},                  // Monday in UTC
+		{"2024-01-01T03:00:00Z", "America/New_York", false}, // still Sunday in New York
+		{"2024-01-02T03:00:00Z", "", false},                 // Tuesday in UTC
+		{"2024-01-02T03:00:00Z", "America/New_York", true},  // still Monday in New York
+	}
+	for _, tt := range tests {
+		clock, err := ClockFromFlags(tt.at, tt.tz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetClock(clock)
+
+		err = Authorizer(context.Background(), RoleServer, "spiffe://domain.test/external", "domain.test", nil)
+		var denied *DeniedError
+		if blocked := errors.As(err, &denied); blocked != tt.blocked || (err != nil && !blocked) {
+			t.Errorf("at %s in %q: got %v, want blocked=%v", tt.at, tt.tz, err, tt.blocked)
+		}
+	}
+}
+
+// chdir changes the working directory, where the policy is read from, until the end of the test
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
@@ -0,0 +1,24 @@
+package opa
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// decisionsTotal counts the authorization decisions by SPIFFE ID and rule
+	decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opa_decisions_total",
+		Help: "Number of authorization decisions by peer SPIFFE ID, rule and decision.",
+	}, []string{"peer_id", "rule", "decision"})
+
+	// evalDuration observes the time spent evaluating queries
+	evalDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "opa_evaluation_duration_seconds",
+		Help:    "Time spent evaluating OPA queries, including policy compilation.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(decisionsTotal, evalDuration)
+}
@@ -3,57 +3,250 @@ package opa
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 // policyFileName is the name of the file where the policy is defined.
 const policyFileName = "policy.rego"
 
-// Authorizer authorizes the workload given the SPIFFE ID and the chain of trust
-func Authorizer(peerID string, _ [][]*x509.Certificate) error {
-	input := map[string]interface{}{"peerID": peerID}
-	log.Printf("OPA Input: %v", input)
+// dataFileName is the name of the optional JSON file holding the data of the
+// policy, e.g. the holidays of the schedules.
+const dataFileName = "data.json"
+
+// policyDirKey is the context key of the directory the policy is read from
+type policyDirKey struct{}
+
+// WithPolicyDir makes the evaluations under ctx read the policy and its data
+// from dir instead of the working directory, e.g. for several services
+// running in the same process.
+func WithPolicyDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, policyDirKey{}, dir)
+}
+
+// policyFile returns the path of the file name in the policy directory of ctx
+func policyFile(ctx context.Context, name string) string {
+	dir, _ := ctx.Value(policyDirKey{}).(string)
+	return filepath.Join(dir, name)
+}
+
+// Role is the side of the connection authorizing its peer.
+type Role string
+
+const (
+	// RoleServer authorizes the clients connecting to a server.
+	RoleServer Role = "server"
+	// RoleClient authorizes the server a client connects to.
+	RoleClient Role = "client"
+	// RoleHTTPServer authorizes the callers of the HTTP API of a client served over mTLS.
+	RoleHTTPServer Role = "http_server"
+)
+
+// allowQueries are the queries deciding whether a peer is authorized, by role.
+var allowQueries = map[Role]string{
+	RoleServer:     "data.example.allow",
+	RoleClient:     "data.example.client.allow_server",
+	RoleHTTPServer: "data.example.client.allow_caller",
+}
+
+// denyReasonsQueries are the queries explaining why a peer is denied, by role.
+var denyReasonsQueries = map[Role]string{
+	RoleServer:     "data.example.deny_reasons",
+	RoleClient:     "data.example.client.deny_reasons",
+	RoleHTTPServer: "data.example.client.caller_deny_reasons",
+}
+
+// allowHTTPQuery and httpDenyReasonsQuery authorize the HTTP callers of a client.
+const (
+	allowHTTPQuery       = "data.example.client.allow_http"
+	httpDenyReasonsQuery = "data.example.client.http_deny_reasons"
+)
+
+// tracer creates the spans of policy evaluations.
+var tracer = otel.Tracer("github.com/opa-spiffe-demo/src/opa")
+
+// errUndefinedDecision is returned by eval when the query has no result.
+var errUndefinedDecision = errors.New("undefined decision")
+
+// Limits holds the rate and concurrency limits of a workload. A zero value
+// means the corresponding limit is not enforced.
+type Limits struct {
+	// Rate is the number of commands per second a workload may issue.
+	Rate float64 `json:"rate"`
+	// Burst is the number of commands a workload may issue at once.
+	Burst int `json:"burst"`
+	// MaxConns is the number of connections a workload may keep open.
+	MaxConns int `json:"max_conns"`
+}
+
+// DeniedError is returned by Authorizer when the policy denies the workload.
+type DeniedError struct {
+	// PeerID is the SPIFFE ID of the denied workload.
+	PeerID string
+	// DecisionID identifies the policy evaluation in the logs.
+	DecisionID string
+	// Rule is the query that denied the workload.
+	Rule string
+	// Reasons are the messages of the deny reasons rule, if the policy defines it.
+	Reasons []string
+}
 
+func (e *DeniedError) Error() string {
+	if len(e.Reasons) == 0 {
+		return fmt.Sprintf("OPA denied request: unexpected peer ID %v", e.PeerID)
+	}
+	return fmt.Sprintf("OPA denied request: %v", strings.Join(e.Reasons, "; "))
+}
+
+// Authorizer authorizes the peer given its SPIFFE ID and the chain of trust.
+// A server evaluates data.example.allow for its clients while a client
+// evaluates data.example.client.allow_server for the server it connects to.
+// The input holds the SPIFFE ID ("peerID"), its trust domain ("trustDomain")
+// and whether it is foreign to localTrustDomain ("federated"), so that the
+// policy can grant partner trust domains a narrower access.
+// A denial is reported as a *DeniedError.
+func Authorizer(ctx context.Context, role Role, peerID, localTrustDomain string, _ [][]*x509.Certificate) error {
+	allowQuery, ok := allowQueries[role]
+	if !ok {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	trustDomain := TrustDomain(peerID)
+	input := map[string]interface{}{
+		"peerID":      peerID,
+		"trustDomain": trustDomain,
+		"federated":   localTrustDomain != "" && trustDomain != localTrustDomain,
+	}
+	return authorize(ctx, allowQuery, denyReasonsQueries[role], peerID, input)
+}
+
+// TrustDomain returns the trust domain of a SPIFFE ID, e.g. domain.test for
+// spiffe://domain.test/db-server, or an empty string if it is invalid.
+func TrustDomain(spiffeID string) string {
+	id, err := spiffeid.FromString(spiffeID)
+	if err != nil {
+		return ""
+	}
+	return id.TrustDomain().String()
+}
+
+// AuthorizeHTTP authorizes an HTTP caller authenticated with a JWT-SVID by
+// evaluating data.example.client.allow_http. The input holds the SPIFFE ID,
+// the claims of the token, the method and the path of the request.
+// A denial is reported as a *DeniedError.
+func AuthorizeHTTP(ctx context.Context, peerID string, claims map[string]interface{}, method, path string) error {
+	input := map[string]interface{}{
+		"peerID": peerID,
+		"claims": claims,
+		"method": method,
+		"path":   path,
+	}
+	return authorize(ctx, allowHTTPQuery, httpDenyReasonsQuery, peerID, input)
+}
+
+// Authorize evaluates a rule, e.g. data.example.http.allow, against an input
+// holding the SPIFFE ID of the peer as "peerID". On denial, the reasons are
+// taken from denyReasonsRule, which may be empty. A denial is reported as a
+// *DeniedError.
+func Authorize(ctx context.Context, rule, denyReasonsRule string, input map[string]interface{}) error {
+	peerID, _ := input["peerID"].(string)
+	return authorize(ctx, rule, denyReasonsRule, peerID, input)
+}
+
+// authorize evaluates the allow query and, on denial, the deny reasons query.
+func authorize(ctx context.Context, allowQuery, denyReasonsQuery, peerID string, input map[string]interface{}) error {
 	// load policy
-	module, err := ioutil.ReadFile(policyFileName)
+	module, err := ioutil.ReadFile(policyFile(ctx, policyFileName))
 	if err != nil {
 		return fmt.Errorf("failed to read policy: %v", err)
 	}
 
-	decision, err := eval(context.Background(), "data.example.allow", input, module)
+	decision, decisionID, err := eval(ctx, allowQuery, input, module)
 	if err != nil {
+		decisionsTotal.WithLabelValues(peerID, allowQuery, "error").Inc()
 		return err
 	}
 
+	logger := slog.With("peer_id", peerID, "decision_id", decisionID, "rule", allowQuery)
+
 	switch x := decision.(type) {
 	case bool:
 		if x {
-			log.Printf("OPA allowed request: peer ID %v", input["peerID"])
+			decisionsTotal.WithLabelValues(peerID, allowQuery, "allow").Inc()
+			logger.InfoContext(ctx, "OPA allowed request", "decision", "allow")
 			return nil
 		} else {
-			return fmt.Errorf("OPA denied request: unexpected peer ID %v", input["peerID"])
+			decisionsTotal.WithLabelValues(peerID, allowQuery, "deny").Inc()
+			var reasons []string
+			if denyReasonsQuery != "" {
+				reasons = denyReasons(ctx, denyReasonsQuery, input, module)
+			}
+			logger.WarnContext(ctx, "OPA denied request", "decision", "deny", "reasons", reasons)
+			return &DeniedError{PeerID: peerID, DecisionID: decisionID, Rule: allowQuery, Reasons: reasons}
 		}
 	default:
+		decisionsTotal.WithLabelValues(peerID, allowQuery, "error").Inc()
+		logger.ErrorContext(ctx, "illegal value for policy evaluation result", "type", fmt.Sprintf("%T", x))
 		return fmt.Errorf("illegal value for policy evaluation result: %T", x)
 	}
 }
 
+// denyReasons evaluates the reasons of a denial. A policy without
+// deny_reasons, or failing to evaluate them, gives no reasons.
+func denyReasons(ctx context.Context, query string, input map[string]interface{}, module []byte) []string {
+	decision, _, err := eval(ctx, query, input, module)
+	if err == errUndefinedDecision {
+		return nil
+	} else if err != nil {
+		slog.WarnContext(ctx, "unable to evaluate deny reasons", "error", err)
+		return nil
+	}
+
+	set, ok := decision.([]interface{})
+	if !ok {
+		slog.WarnContext(ctx, "illegal value for deny reasons", "type", fmt.Sprintf("%T", decision))
+		return nil
+	}
+
+	reasons := make([]string, 0, len(set))
+	for _, reason := range set {
+		reasons = append(reasons, fmt.Sprint(reason))
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
 // GetPiiFromPolicy evaluates a Rego policy and returns the PII fields
-func GetPiiFromPolicy(peerID string) ([]interface{}, error) {
-	input := map[string]interface{}{"peerID": peerID}
-	log.Printf("OPA Input: %v", input)
+func GetPiiFromPolicy(ctx context.Context, peerID string) ([]interface{}, error) {
+	input := map[string]interface{}{"peerID": peerID, "trustDomain": TrustDomain(peerID)}
 
 	// load policy
-	module, err := ioutil.ReadFile(policyFileName)
+	module, err := ioutil.ReadFile(policyFile(ctx, policyFileName))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read policy: %v", err)
 	}
 
-	decision, err := eval(context.Background(), "data.example.pii", input, module)
+	decision, _, err := eval(ctx, "data.example.pii", input, module)
 	if err != nil {
 		return nil, err
 	}
@@ -66,27 +259,138 @@ func GetPiiFromPolicy(peerID string) ([]interface{}, error) {
 	}
 }
 
-// eval evaluates OPA query
-func eval(ctx context.Context, query string, input map[string]interface{}, policy []byte) (interface{}, error) {
+// GetLimitsFromPolicy evaluates a Rego policy and returns the limits of the workload.
+// Workloads without an entry in data.example.limits are not limited.
+func GetLimitsFromPolicy(ctx context.Context, peerID string) (Limits, error) {
+	input := map[string]interface{}{"peerID": peerID}
+
+	// load policy
+	module, err := ioutil.ReadFile(policyFile(ctx, policyFileName))
+	if err != nil {
+		return Limits{}, fmt.Errorf("failed to read policy: %v", err)
+	}
+
+	decision, _, err := eval(ctx, "data.example.limits[input.peerID]", input, module)
+	if err == errUndefinedDecision {
+		return Limits{}, nil
+	} else if err != nil {
+		return Limits{}, err
+	}
+
+	x, ok := decision.(map[string]interface{})
+	if !ok {
+		return Limits{}, fmt.Errorf("illegal value for policy evaluation result: %T", decision)
+	}
+
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return Limits{}, err
+	}
+
+	var limits Limits
+	if err := json.Unmarshal(bs, &limits); err != nil {
+		return Limits{}, fmt.Errorf("illegal value for policy evaluation result: %v", err)
+	}
+	return limits, nil
+}
+
+// eval evaluates OPA query. It returns the result along with the ID of the
+// decision, which identifies the evaluation in the logs and traces.
+func eval(ctx context.Context, query string, input map[string]interface{}, policy []byte) (interface{}, string, error) {
+	timer := prometheus.NewTimer(evalDuration.WithLabelValues(query))
+	defer timer.ObserveDuration()
+
+	decisionID := newDecisionID()
+	ctx, span := tracer.Start(ctx, "opa.eval", trace.WithAttributes(
+		attribute.String("opa.query", query),
+		attribute.String("opa.decision_id", decisionID),
+	))
+	defer span.End()
+
+	// Policies read the time from the input so that it can be pinned. The
+	// input of the caller is left as is, it may be evaluated again or logged.
+	t := now()
+	input = withTime(input, t)
+	logger := slog.With("decision_id", decisionID, "query", query, "input", input)
+
+	store, err := loadData(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		logger.ErrorContext(ctx, "OPA evaluation failed", "error", err)
+		return nil, decisionID, err
+	}
 
 	// Create a new query
-	r := rego.New(
+	options := []func(*rego.Rego){
 		rego.Query(query),
 		rego.Module(policyFileName, string(policy)),
 		rego.Input(input),
-	)
+		scheduleWithin(t),
+	}
+	options = append(options, spiffeBuiltins...)
+	if store != nil {
+		options = append(options, rego.Store(store))
+	}
+	r := rego.New(options...)
 
 	// Run evaluation
 	rs, err := r.Eval(ctx)
 
 	if err != nil {
-		return nil, err
+		span.SetStatus(codes.Error, err.Error())
+		logger.ErrorContext(ctx, "OPA evaluation failed", "error", err)
+		return nil, decisionID, err
 	} else if len(rs) == 0 {
-		return nil, fmt.Errorf("undefined decision")
+		span.SetAttributes(attribute.String("opa.result", "undefined"))
+		logger.DebugContext(ctx, "OPA evaluation is undefined")
+		return nil, decisionID, errUndefinedDecision
 	} else if len(rs) > 1 {
-		return nil, fmt.Errorf("multiple evaluation results")
+		span.SetStatus(codes.Error, "multiple evaluation results")
+		logger.ErrorContext(ctx, "OPA evaluation has multiple results")
+		return nil, decisionID, fmt.Errorf("multiple evaluation results")
 	}
 
 	// Inspect results
-	return rs[0].Expressions[0].Value, nil
+	result := rs[0].Expressions[0].Value
+	span.SetAttributes(attribute.String("opa.result", fmt.Sprint(result)))
+	logger.DebugContext(ctx, "OPA evaluated query", "result", result)
+	return result, decisionID, nil
+}
+
+// withTime returns a copy of input holding the time of the decision as
+// "now_ns" and the time zone of the days as "tz"
+func withTime(input map[string]interface{}, t time.Time) map[string]interface{} {
+	r := make(map[string]interface{}, len(input)+2)
+	for k, v := range input {
+		r[k] = v
+	}
+	r["now_ns"] = t.UnixNano()
+	r["tz"] = t.Location().String()
+	return r
+}
+
+// newDecisionID returns a random ID identifying a policy evaluation.
+func newDecisionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// loadData loads the data of the policy, it returns nil if there is no data file
+func loadData(ctx context.Context) (storage.Store, error) {
+	f, err := os.Open(policyFile(ctx, dataFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read policy data: %v", err)
+	}
+	defer f.Close()
+
+	var data map[string]interface{}
+	if err := util.NewJSONDecoder(f).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode policy data: %v", err)
+	}
+	return inmem.NewFromObject(data), nil
 }
@@ -0,0 +1,90 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAuthorizeLeavesInputUnchanged evaluates the same input on two days, the
+// time of the first decision must not leak into the second one
+func TestAuthorizeLeavesInputUnchanged(t *testing.T) {
+	chdir(t, filepath.Join("..", "..", "docker", "db", "opa"))
+	t.Cleanup(func() { SetClock(func() time.Time { return time.Now().UTC() }) })
+
+	input := map[string]interface{}{
+		"peerID":      "spiffe://domain.test/external",
+		"trustDomain": "domain.test",
+		"federated":   false,
+	}
+	want := map[string]interface{}{}
+	for k, v := range input {
+		want[k] = v
+	}
+
+	days := []struct {
+		day     time.Time
+		blocked bool
+	}{
+		{time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC), true},  // Monday
+		{time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC), false}, // Tuesday
+	}
+	for _, d := range days {
+		SetClock(FixedClock(d.day))
+		err := Authorize(context.Background(), "data.example.allow", "data.example.deny_reasons", input)
+		var denied *DeniedError
+		if blocked := errors.As(err, &denied); blocked != d.blocked || (err != nil && !blocked) {
+			t.Errorf("on %v: got %v, want blocked=%v", d.day.Weekday(), err, d.blocked)
+		}
+		if !reflect.DeepEqual(input, want) {
+			t.Errorf("on %v: input changed to %v", d.day.Weekday(), input)
+		}
+	}
+}
+
+// TestClientAuthorizesDBServer evaluates the client policy, which only trusts
+// the db server of the trust domain
+func TestClientAuthorizesDBServer(t *testing.T) {
+	chdir(t, filepath.Join("..", "..", "docker", "privileged", "opa"))
+
+	tests := []struct {
+		peerID  string
+		reasons []string
+	}{
+		{"spiffe://domain.test/db-server", nil},
+		{"spiffe://domain.test/external", []string{"spiffe://domain.test/external is not a trusted db server"}},
+		{"spiffe://partner.test/db-server", []string{"spiffe://partner.test/db-server is not a trusted db server"}},
+	}
+	for _, tt := range tests {
+		err := Authorizer(context.Background(), RoleClient, tt.peerID, "domain.test", nil)
+		if tt.reasons == nil {
+			if err != nil {
+				t.Errorf("%s: got %v, want allowed", tt.peerID, err)
+			}
+			continue
+		}
+		var denied *DeniedError
+		if !errors.As(err, &denied) {
+			t.Errorf("%s: got %v, want denied", tt.peerID, err)
+			continue
+		}
+		if denied.Rule != "data.example.client.allow_server" || !reflect.DeepEqual(denied.Reasons, tt.reasons) {
+			t.Errorf("%s: got rule %q and reasons %q, want data.example.client.allow_server and %q", tt.peerID, denied.Rule, denied.Reasons, tt.reasons)
+		}
+	}
+}
+
+// TestWithPolicyDir reads the client policy from its directory while the
+// working directory has no policy
+func TestWithPolicyDir(t *testing.T) {
+	ctx := WithPolicyDir(context.Background(), filepath.Join("..", "..", "docker", "privileged", "opa"))
+	if err := Authorizer(ctx, RoleClient, "spiffe://domain.test/db-server", "domain.test", nil); err != nil {
+		t.Errorf("got %v, want allowed by the policy of the directory", err)
+	}
+	if err := Authorizer(context.Background(), RoleClient, "spiffe://domain.test/db-server", "domain.test", nil); err == nil {
+		t.Error("got allowed without a policy in the working directory")
+	}
+}
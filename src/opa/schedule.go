@@ -0,0 +1,172 @@
+package opa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// scheduleWithinDecl declares schedule.within(spec, tz), which tells whether
+// the time of the decision is within the Schedule spec in the IANA time zone
+// tz, e.g. "America/New_York", or UTC if tz is empty
+var scheduleWithinDecl = &rego.Function{
+	Name: "schedule.within",
+	Decl: types.NewFunction(types.Args(types.A, types.S), types.B),
+}
+
+// Schedule is a set of weekly windows, e.g.
+//
+//	{"windows": [{"days": ["Monday", "Tuesday"], "start": "09:00", "end": "17:00"}], "holidays": ["2024-12-25"]}
+//
+// A window without days applies every day, start defaults to 00:00 and end to
+// 24:00, which is not a valid start. A window ending before it starts spans midnight, e.g. 22:00 to 06:00.
+// Times are local wall clock times, so a window follows the DST transitions of
+// the time zone. No window starts on the holidays, given as local dates, the
+// end of a window spanning midnight belonging to the day it started.
+type Schedule struct {
+	Windows  []Window `json:"windows"`
+	Holidays []string `json:"holidays"`
+}
+
+// Window is a daily window of a Schedule
+type Window struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// Within tells whether t, in its location, is within one of the windows
+func (s Schedule) Within(t time.Time) (bool, error) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.Windows {
+		start, err := parseMinute(w.Start, 0)
+		if err != nil {
+			return false, err
+		}
+		if start == 24*60 {
+			return false, fmt.Errorf("invalid start %q, only the end of a window may be 24:00", w.Start)
+		}
+		end, err := parseMinute(w.End, 24*60)
+		if err != nil {
+			return false, err
+		}
+		today, err := s.startsOn(w, t)
+		if err != nil {
+			return false, err
+		}
+
+		if start < end {
+			if today && minute >= start && minute < end {
+				return true, nil
+			}
+			continue
+		}
+
+		// The window spans midnight, its end belongs to the window of the previous day
+		yesterday, err := s.startsOn(w, t.AddDate(0, 0, -1))
+		if err != nil {
+			return false, err
+		}
+		if (today && minute >= start) || (yesterday && minute < end) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// startsOn tells whether the window starts on the date of t, which must not be a holiday
+func (s Schedule) startsOn(w Window, t time.Time) (bool, error) {
+	date := t.Format("2006-01-02")
+	for _, holiday := range s.Holidays {
+		if holiday == date {
+			return false, nil
+		}
+	}
+	return w.appliesOn(t.Weekday())
+}
+
+// appliesOn tells whether the window applies on a day
+func (w Window) appliesOn(day time.Weekday) (bool, error) {
+	if len(w.Days) == 0 {
+		return true, nil
+	}
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return false, fmt.Errorf("invalid day %q", d)
+		}
+		if wd == day {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseMinute parses a HH:MM time into minutes since midnight, 24:00 being the end of the day
+func parseMinute(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduleWithin returns the schedule.within built-in evaluated at now
+func scheduleWithin(now time.Time) func(*rego.Rego) {
+	return rego.Function2(scheduleWithinDecl, func(_ rego.BuiltinContext, spec, tz *ast.Term) (*ast.Term, error) {
+		var s Schedule
+		if err := fromTerm(spec, &s); err != nil {
+			return nil, fmt.Errorf("invalid schedule: %v", err)
+		}
+
+		name, ok := tz.Value.(ast.String)
+		if !ok {
+			return nil, errors.New("time zone must be a string")
+		}
+		loc, err := time.LoadLocation(string(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %v", name, err)
+		}
+
+		within, err := s.Within(now.In(loc))
+		if err != nil {
+			return nil, err
+		}
+		return ast.BooleanTerm(within), nil
+	})
+}
+
+// fromTerm decodes a Rego value into v
+func fromTerm(term *ast.Term, v interface{}) error {
+	i, err := ast.JSON(term.Value)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
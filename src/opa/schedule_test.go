@@ -0,0 +1,123 @@
+package opa
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleWithin(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	businessHours := Schedule{
+		Windows:  []Window{{Days: []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"}, Start: "09:00", End: "18:00"}},
+		Holidays: []string{"2024-12-25"},
+	}
+	// Holidays are local dates, 22:00 in New York is already the next day in UTC
+	allDay := Schedule{Windows: []Window{{}}, Holidays: []string{"2024-12-25"}}
+	// Sunday 01:00 to 03:30 spans both DST transitions of 2024 in New York
+	maintenance := Schedule{Windows: []Window{{Days: []string{"sunday"}, Start: "01:00", End: "03:30"}}}
+	overnight := Schedule{Windows: []Window{{Days: []string{"Friday"}, Start: "22:00", End: "06:00"}}}
+	overnightFromHoliday := Schedule{Windows: overnight.Windows, Holidays: []string{"2024-03-08"}}
+	overnightToHoliday := Schedule{Windows: overnight.Windows, Holidays: []string{"2024-03-09"}}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		at       string
+		want     bool
+	}{
+		{"09:30 EST", businessHours, "2024-03-08T14:30:00Z", true},
+		{"08:30 EST", businessHours, "2024-03-08T13:30:00Z", false},
+		{"09:30 EDT after spring forward", businessHours, "2024-03-11T13:30:00Z", true},
+		{"17:30 EST", businessHours, "2024-03-08T22:30:00Z", true},
+		{"18:30 EDT after spring forward", businessHours, "2024-03-11T22:30:00Z", false},
+		{"Saturday", businessHours, "2024-03-09T15:00:00Z", false},
+		{"holiday", businessHours, "2024-12-25T15:00:00Z", false},
+		{"holiday in New York only", allDay, "2024-12-26T03:00:00Z", false},
+		{"holiday in UTC only", allDay, "2024-12-25T03:00:00Z", true},
+
+		{"01:45 EST before spring forward", maintenance, "2024-03-10T06:45:00Z", true},
+		{"03:15 EDT after spring forward", maintenance, "2024-03-10T07:15:00Z", true},
+		{"03:45 EDT after spring forward", maintenance, "2024-03-10T07:45:00Z", false},
+		{"00:30 EDT before fall back", maintenance, "2024-11-03T04:30:00Z", false},
+		{"first 01:30 EDT", maintenance, "2024-11-03T05:30:00Z", true},
+		{"second 01:30 EST", maintenance, "2024-11-03T06:30:00Z", true},
+		{"03:45 EST after fall back", maintenance, "2024-11-03T08:45:00Z", false},
+
+		{"Friday 21:00", overnight, "2024-03-09T02:00:00Z", false},
+		{"Friday 23:00", overnight, "2024-03-09T04:00:00Z", true},
+		{"Saturday 03:00", overnight, "2024-03-09T08:00:00Z", true},
+		{"Saturday 07:00", overnight, "2024-03-09T12:00:00Z", false},
+		{"Sunday 03:00", overnight, "2024-03-10T07:00:00Z", false},
+		{"Friday 23:00 on a holiday", overnightFromHoliday, "2024-03-09T04:00:00Z", false},
+		{"Saturday 03:00 after a holiday", overnightFromHoliday, "2024-03-09T08:00:00Z", false},
+		{"Friday 23:00 before a holiday", overnightToHoliday, "2024-03-09T04:00:00Z", true},
+		{"Saturday 03:00 on a holiday", overnightToHoliday, "2024-03-09T08:00:00Z", true},
+	}
+	for _, tt := range tests {
+		at, err := time.Parse(time.RFC3339, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tt.schedule.Within(at.In(newYork))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: Within(%v) = %v, want %v", tt.name, at.In(newYork), got, tt.want)
+		}
+	}
+}
+
+func TestScheduleWithinInvalid(t *testing.T) {
+	for _, s := range []Schedule{
+		{Windows: []Window{{Days: []string{"Funday"}}}},
+		{Windows: []Window{{Start: "9am"}}},
+		{Windows: []Window{{End: "25:00"}}},
+		{Windows: []Window{{Start: "24:00", End: "06:00"}}},
+	} {
+		if _, err := s.Within(time.Now()); err == nil {
+			t.Errorf("Within succeeded with %+v, want an error", s)
+		}
+	}
+}
+
+// TestPartnerHours evaluates the db policy, which lets partners in during the
+// business hours of New York except on the holidays of data.json
+func TestPartnerHours(t *testing.T) {
+	chdir(t, filepath.Join("..", "..", "docker", "db", "opa"))
+	t.Cleanup(func() { SetClock(func() time.Time { return time.Now().UTC() }) })
+
+	tests := []struct {
+		at      string
+		reasons []string
+	}{
+		{"2024-03-11T13:30:00Z", nil}, // 09:30 EDT
+		{"2024-03-08T13:30:00Z", []string{"partners are only allowed during the business hours of America/New_York"}}, // 08:30 EST
+		{"2024-12-25T15:00:00Z", []string{"partners are only allowed during the business hours of America/New_York"}}, // Christmas
+	}
+	for _, tt := range tests {
+		at, err := time.Parse(time.RFC3339, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		SetClock(FixedClock(at))
+
+		err = Authorizer(context.Background(), RoleServer, "spiffe://partner.test/app", "domain.test", nil)
+		var denied *DeniedError
+		switch {
+		case tt.reasons == nil && err != nil:
+			t.Errorf("at %s: got %v, want allowed", tt.at, err)
+		case tt.reasons != nil && !errors.As(err, &denied):
+			t.Errorf("at %s: got %v, want denied", tt.at, err)
+		case tt.reasons != nil && !reflect.DeepEqual(denied.Reasons, tt.reasons):
+			t.Errorf("at %s: got reasons %q, want %q", tt.at, denied.Reasons, tt.reasons)
+		}
+	}
+}
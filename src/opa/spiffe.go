@@ -0,0 +1,132 @@
+package opa
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// spiffeBuiltins are the built-ins parsing and matching SPIFFE IDs with the
+// rules of go-spiffe, e.g. trust domains are case insensitive
+var spiffeBuiltins = []func(*rego.Rego){
+	// spiffe.parse(id) returns {"trust_domain", "path", "segments"}, it is
+	// undefined if id is not a valid SPIFFE ID
+	rego.Function1(&rego.Function{
+		Name: "spiffe.parse",
+		Decl: types.NewFunction(types.Args(types.S), types.NewObject([]*types.StaticProperty{
+			types.NewStaticProperty("trust_domain", types.S),
+			types.NewStaticProperty("path", types.S),
+			types.NewStaticProperty("segments", types.NewArray(nil, types.S)),
+		}, nil)),
+	}, builtinSPIFFEParse),
+
+	// spiffe.match(id, pattern) tells whether id matches a pattern such as
+	// spiffe://domain.test/ns/*/sa/**, where * matches a path segment and **
+	// any number of them
+	rego.Function2(&rego.Function{
+		Name: "spiffe.match",
+		Decl: types.NewFunction(types.Args(types.S, types.S), types.B),
+	}, builtinSPIFFEMatch),
+
+	// spiffe.member_of(id, trust_domain) tells whether id belongs to the trust
+	// domain, given as domain.test or spiffe://domain.test
+	rego.Function2(&rego.Function{
+		Name: "spiffe.member_of",
+		Decl: types.NewFunction(types.Args(types.S, types.S), types.B),
+	}, builtinSPIFFEMemberOf),
+}
+
+func builtinSPIFFEParse(_ rego.BuiltinContext, a *ast.Term) (*ast.Term, error) {
+	s, ok := a.Value.(ast.String)
+	if !ok {
+		return nil, errors.New("SPIFFE ID must be a string")
+	}
+	id, err := spiffeid.FromString(string(s))
+	if err != nil {
+		return nil, nil
+	}
+
+	var segments []*ast.Term
+	for _, segment := range pathSegments(id.Path()) {
+		segments = append(segments, ast.StringTerm(segment))
+	}
+	return ast.ObjectTerm(
+		ast.Item(ast.StringTerm("trust_domain"), ast.StringTerm(id.TrustDomain().String())),
+		ast.Item(ast.StringTerm("path"), ast.StringTerm(id.Path())),
+		ast.Item(ast.StringTerm("segments"), ast.ArrayTerm(segments...)),
+	), nil
+}
+
+func builtinSPIFFEMatch(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+	s, ok1 := a.Value.(ast.String)
+	pattern, ok2 := b.Value.(ast.String)
+	if !ok1 || !ok2 {
+		return nil, errors.New("SPIFFE ID and pattern must be strings")
+	}
+	match, err := matchID(string(s), string(pattern))
+	if err != nil {
+		return nil, err
+	}
+	return ast.BooleanTerm(match), nil
+}
+
+func builtinSPIFFEMemberOf(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+	s, ok1 := a.Value.(ast.String)
+	trustDomain, ok2 := b.Value.(ast.String)
+	if !ok1 || !ok2 {
+		return nil, errors.New("SPIFFE ID and trust domain must be strings")
+	}
+	td, err := spiffeid.TrustDomainFromString(string(trustDomain))
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust domain %q: %v", trustDomain, err)
+	}
+	id, err := spiffeid.FromString(string(s))
+	return ast.BooleanTerm(err == nil && id.MemberOf(td)), nil
+}
+
+// matchID tells whether a SPIFFE ID matches a pattern. An invalid ID matches
+// no pattern, an invalid pattern is an error.
+func matchID(s, pattern string) (bool, error) {
+	p, err := spiffeid.FromString(pattern)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	id, err := spiffeid.FromString(s)
+	if err != nil || !id.MemberOf(p.TrustDomain()) {
+		return false, nil
+	}
+	return matchSegments(pathSegments(p.Path()), pathSegments(id.Path())), nil
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	switch pattern[0] {
+	case "**":
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(segments) > 0 && matchSegments(pattern[1:], segments[1:])
+	default:
+		return len(segments) > 0 && segments[0] == pattern[0] && matchSegments(pattern[1:], segments[1:])
+	}
+}
+
+// pathSegments splits the path of a SPIFFE ID, e.g. /ns/prod into [ns prod]
+func pathSegments(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
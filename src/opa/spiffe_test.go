@@ -0,0 +1,111 @@
+package opa
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMatchID(t *testing.T) {
+	tests := []struct {
+		id, pattern string
+		want        bool
+	}{
+		{"spiffe://domain.test/db-server", "spiffe://domain.test/db-server", true},
+		{"spiffe://Domain.Test/db-server", "spiffe://domain.test/db-server", true},
+		{"spiffe://domain.test/db-server", "spiffe://partner.test/db-server", false},
+		{"spiffe://domain.test/ns/prod/sa/api", "spiffe://domain.test/ns/*/sa/api", true},
+		{"spiffe://domain.test/ns/prod/sa/api", "spiffe://domain.test/ns/*/sa/web", false},
+		{"spiffe://domain.test/ns/prod/sa/api", "spiffe://domain.test/ns/*", false},
+		{"spiffe://domain.test/ns/prod/sa/api", "spiffe://domain.test/ns/**", true},
+		{"spiffe://domain.test/ns", "spiffe://domain.test/ns/**", true},
+		{"spiffe://domain.test/ns/prod/sa/api", "spiffe://domain.test/**/api", true},
+		{"spiffe://domain.test/api", "spiffe://domain.test/**/api", true},
+		{"spiffe://domain.test", "spiffe://domain.test/**", true},
+		{"spiffe://domain.test", "spiffe://domain.test/*", false},
+		{"spiffe://domain.test/nsx/prod", "spiffe://domain.test/ns/**", false},
+		{"https://domain.test/ns/prod", "spiffe://domain.test/ns/**", false},
+	}
+	for _, tt := range tests {
+		got, err := matchID(tt.id, tt.pattern)
+		if err != nil {
+			t.Errorf("matchID(%q, %q): %v", tt.id, tt.pattern, err)
+		} else if got != tt.want {
+			t.Errorf("matchID(%q, %q) = %v, want %v", tt.id, tt.pattern, got, tt.want)
+		}
+	}
+
+	if _, err := matchID("spiffe://domain.test/api", "domain.test/*"); err == nil {
+		t.Error("matchID succeeded with an invalid pattern, want an error")
+	}
+}
+
+// spiffePolicy exercises the built-ins, a rule is undefined when its built-in is
+const spiffePolicy = `package test
+
+parsed = spiffe.parse(input.id)
+
+matched = spiffe.match(input.id, "spiffe://domain.test/workloads/**")
+
+member = spiffe.member_of(input.id, "domain.test")
+`
+
+func TestSPIFFEBuiltins(t *testing.T) {
+	tests := []struct {
+		id      string
+		parsed  interface{}
+		matched bool
+		member  bool
+	}{
+		{
+			id: "spiffe://domain.test/workloads/external",
+			parsed: map[string]interface{}{
+				"trust_domain": "domain.test",
+				"path":         "/workloads/external",
+				"segments":     []interface{}{"workloads", "external"},
+			},
+			matched: true,
+			member:  true,
+		},
+		{
+			id: "spiffe://partner.test/workloads/external",
+			parsed: map[string]interface{}{
+				"trust_domain": "partner.test",
+				"path":         "/workloads/external",
+				"segments":     []interface{}{"workloads", "external"},
+			},
+		},
+		{
+			id: "spiffe://DOMAIN.test",
+			parsed: map[string]interface{}{
+				"trust_domain": "domain.test",
+				"path":         "",
+				"segments":     []interface{}{},
+			},
+			member: true,
+		},
+		{id: "not a SPIFFE ID"},
+	}
+	for _, tt := range tests {
+		input := map[string]interface{}{"id": tt.id}
+
+		parsed, _, err := eval(context.Background(), "data.test.parsed", input, []byte(spiffePolicy))
+		if tt.parsed == nil {
+			if err != errUndefinedDecision {
+				t.Errorf("spiffe.parse(%q) = %v, %v, want undefined", tt.id, parsed, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(parsed, tt.parsed) {
+			t.Errorf("spiffe.parse(%q) = %v, %v, want %v", tt.id, parsed, err, tt.parsed)
+		}
+
+		matched, _, err := eval(context.Background(), "data.test.matched", input, []byte(spiffePolicy))
+		if err != nil || matched != tt.matched {
+			t.Errorf("spiffe.match(%q) = %v, %v, want %v", tt.id, matched, err, tt.matched)
+		}
+
+		member, _, err := eval(context.Background(), "data.test.member", input, []byte(spiffePolicy))
+		if err != nil || member != tt.member {
+			t.Errorf("spiffe.member_of(%q) = %v, %v, want %v", tt.id, member, err, tt.member)
+		}
+	}
+}